@@ -10,20 +10,31 @@ import (
 )
 
 // todo(): support newlines in key/val?
-// todo(): handle concurrency
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	rootDir := "./output"
+	// engine options come from CONFIG_FILE, overridden by NOB_* variables
+	var configFile string
 	for _, kv := range os.Environ() {
 		kva := strings.Split(kv, "=")
 
 		if kva[0] == "ROOT_DIR" {
 			rootDir = kva[1]
 		}
+		if kva[0] == "CONFIG_FILE" {
+			configFile = kva[1]
+		}
 	}
 	fmt.Println("Output dir: ", rootDir)
-	nob := engine.NewNob(rootDir)
+	opts, err := engine.LoadOptions(configFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	nob, err := engine.NewNobWithOptions(rootDir, opts)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	cmd := os.Args[1]
 	switch cmd {
@@ -32,7 +43,10 @@ func main() {
 			key := os.Args[2]
 			val := os.Args[3]
 			fmt.Printf("SET %v %v\n", key, val)
-			nob.Set(key, val)
+			err := nob.Set(key, val)
+			if err != nil {
+				log.Fatalln(err)
+			}
 		}
 	case "get":
 		{
@@ -44,6 +58,34 @@ func main() {
 			}
 			fmt.Println("val: ", val)
 		}
+	case "del":
+		{
+			key := os.Args[2]
+			fmt.Printf("DEL %v\n", key)
+			err := nob.Delete(key)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+	case "scan":
+		{
+			var start, end string
+			if len(os.Args) > 2 {
+				start = os.Args[2]
+			}
+			if len(os.Args) > 3 {
+				end = os.Args[3]
+			}
+
+			it := nob.Scan(start, end)
+			for it.Next() {
+				fmt.Println(it.Key(), it.Value())
+			}
+			it.Close()
+			if err := it.Err(); err != nil {
+				log.Fatalln(err)
+			}
+		}
 	case "http":
 		{
 			run(nob)
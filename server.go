@@ -1,11 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"git.target.com/eric.miranda/mydb/v2/src/engine"
 )
@@ -13,6 +20,17 @@ import (
 func run(nob *engine.Nob) {
 	http.HandleFunc("/get/", GetHandler(nob))
 	http.HandleFunc("POST /set/", SetHandler(nob))
+	http.HandleFunc("DELETE /del/", DeleteHandler(nob))
+	http.HandleFunc("POST /incr/", IncrHandler(nob))
+	http.HandleFunc("GET /scan", ScanHandler(nob))
+	http.HandleFunc("GET /ttl/", TTLHandler(nob))
+	http.HandleFunc("GET /stats", StatsHandler(nob))
+	http.HandleFunc("POST /batch", BatchHandler(nob))
+	txns := newTxnRegistry(TXN_TTL)
+	http.HandleFunc("POST /txn/begin", BeginHandler(nob, txns))
+	http.HandleFunc("GET /txn/get/", TxnGetHandler(txns))
+	http.HandleFunc("POST /txn/commit", CommitHandler(txns))
+	http.HandleFunc("POST /txn/rollback", RollbackHandler(txns))
 
 	middlewared := LoggingMiddleware(http.DefaultServeMux)
 
@@ -22,28 +40,453 @@ func run(nob *engine.Nob) {
 	}
 }
 
+// SetHandler writes a key, conditionally with an If-Match or If-None-Match header:
+//
+//	If-Match: "7"      only if the value still is version 7, as in the ETag of a GET
+//	If-Match: *        only if the key has a value
+//	If-None-Match: *   only if the key has no value
+//
+// A failed condition is 412 Precondition Failed, a conditional write returns
+// the ETag of the version it wrote.
+//
+// A TTL header or ?ttl= query parameter, in seconds or as a duration like 15m,
+// expires the key after it. It can't be combined with a condition.
 func SetHandler(nob *engine.Nob) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		key, _ := strings.CutPrefix(r.URL.String(), "/set/")
+		key, _ := strings.CutPrefix(r.URL.EscapedPath(), "/set/")
 		bb, err := io.ReadAll(r.Body)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		val := string(bb)
-		nob.Set(key, val)
+
+		ttl := r.Header.Get("TTL")
+		if q := r.URL.Query().Get("ttl"); q != "" {
+			ttl = q
+		}
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		if ttl != "" {
+			d, ok := parseTTL(ttl)
+			if !ok {
+				http.Error(w, "bad ttl "+ttl, http.StatusBadRequest)
+				return
+			}
+			if ifMatch != "" || ifNoneMatch != "" {
+				http.Error(w, "a ttl can't be combined with If-Match or If-None-Match", http.StatusBadRequest)
+				return
+			}
+			err = nob.SetWithTTL(key, val, d)
+		} else if ifMatch != "" || ifNoneMatch != "" {
+			var version uint64
+			switch {
+			case ifMatch != "" && ifNoneMatch != "":
+				http.Error(w, "If-Match and If-None-Match can't be combined", http.StatusBadRequest)
+				return
+			case ifNoneMatch == "*":
+				version, err = nob.SetIfAbsent(key, val)
+			case ifNoneMatch != "":
+				http.Error(w, "If-None-Match only supports *", http.StatusBadRequest)
+				return
+			case ifMatch == "*":
+				version, err = nob.SetIfVersion(key, val, engine.ANY_VERSION)
+			default:
+				var ok bool
+				if version, ok = parseETag(ifMatch); !ok {
+					http.Error(w, "bad If-Match "+ifMatch, http.StatusBadRequest)
+					return
+				}
+				version, err = nob.SetIfVersion(key, val, version)
+			}
+			if err == engine.ErrConditionFailed {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			if err == nil {
+				w.Header().Set("ETag", formatETag(version))
+			}
+		} else {
+			err = nob.Set(key, val)
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		w.WriteHeader(http.StatusCreated)
 	}
 }
 
+func DeleteHandler(nob *engine.Nob) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, _ := strings.CutPrefix(r.URL.EscapedPath(), "/del/")
+		err := nob.Delete(key)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// IncrHandler merges the body, 1 if empty, into a key. Under the default merge
+// operator that adds it to a counter, 400 if the body isn't an integer. The value isn't
+// read, if it isn't an integer reading the key fails with 409 until it's set again.
+func IncrHandler(nob *engine.Nob) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, _ := strings.CutPrefix(r.URL.EscapedPath(), "/incr/")
+		bb, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		operand := strings.TrimSpace(string(bb))
+		if operand == "" {
+			operand = "1"
+		}
+
+		err = nob.Merge(key, operand)
+		if errors.Is(err, engine.ErrMergeFailed) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GetHandler reads the latest value of a key, with its version as the ETag,
+// or the value as of ?seq=, which can't be past the latest write. Versions older than
+// every open transaction may have been compacted away, reads that need them to stay
+// belong in a transaction, see TxnGetHandler.
+//
+// A key whose merge operands don't apply to its value is 409 Conflict, see IncrHandler.
 func GetHandler(nob *engine.Nob) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		key, _ := strings.CutPrefix(req.URL.String(), "/get/")
+		key, _ := strings.CutPrefix(req.URL.EscapedPath(), "/get/")
+
+		var val string
+		var err error
+		if s := req.URL.Query().Get("seq"); s != "" {
+			seq, perr := strconv.ParseUint(s, 10, 64)
+			if perr != nil || seq > nob.LastSequence() {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			val, err = nob.GetAt(key, seq)
+		} else {
+			var version uint64
+			val, version, err = nob.GetVersion(key)
+			if err == nil {
+				w.Header().Set("ETag", formatETag(version))
+			}
+		}
+		if err == engine.ErrKeyNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, engine.ErrMergeFailed) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, err = fmt.Fprintf(w, "val for %v is %v", key, val)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
 
-		val, err := nob.Get(key)
+// parseTTL(s) reads whole seconds or a duration, which must be positive
+func parseTTL(s string) (time.Duration, bool) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, err := strconv.ParseInt(s, 10, 64)
 		if err != nil {
+			return 0, false
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	return d, d > 0
+}
+
+// TTLHandler writes the whole seconds a key has left to live, rounded up,
+// or -1 if it doesn't expire
+func TTLHandler(nob *engine.Nob) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, _ := strings.CutPrefix(r.URL.EscapedPath(), "/ttl/")
+		ttl, err := nob.TTL(key)
+		if err == engine.ErrKeyNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		secs := int64(-1)
+		if ttl != engine.NO_TTL {
+			secs = int64((ttl + time.Second - 1) / time.Second)
+		}
+		_, err = fmt.Fprintf(w, "%v\n", secs)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// formatETag(version) returns the strong ETag of a value version
+func formatETag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+func parseETag(etag string) (uint64, bool) {
+	s, err := strconv.Unquote(strings.TrimSpace(etag))
+	if err != nil {
+		return 0, false
+	}
+	version, err := strconv.ParseUint(s, 10, 64)
+	return version, err == nil
+}
+
+// ScanHandler streams "key value" lines for keys in [start, end), up to limit lines.
+// A segment failing to read mid-stream aborts the response, so it can't pass for complete.
+// Keys whose merge operands don't apply to their value are left out, and listed
+// comma separated in the Skipped-Keys trailer.
+func ScanHandler(nob *engine.Nob) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit := -1
+		if l := query.Get("limit"); l != "" {
+			var err error
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		it := nob.Scan(query.Get("start"), query.Get("end"))
+		defer it.Close()
+
+		w.Header().Set("Trailer", "Skipped-Keys")
+		flusher, _ := w.(http.Flusher)
+		n := 0
+		for ; n != limit && it.Next(); n++ {
+			_, err := fmt.Fprintf(w, "%v %v\n", it.Key(), it.Value())
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err := it.Err(); err != nil {
+			log.Println(err)
+			if n > 0 {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if failed := it.Failed(); len(failed) > 0 {
+			w.Header().Set("Skipped-Keys", strings.Join(slices.Sorted(maps.Keys(failed)), ","))
+		}
+	}
+}
+
+// batchOp is an element of a POST /batch body, op being "set" or "del"
+type batchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// BatchHandler applies a JSON array of ops atomically, e.g.
+//
+//	[{"op": "set", "key": "foo", "value": "bar"}, {"op": "del", "key": "baz"}]
+//
+// The whole body is validated first, a bad op fails the request before anything is written.
+func BatchHandler(nob *engine.Nob) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ops []batchOp
+		err := json.NewDecoder(r.Body).Decode(&ops)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		batch := engine.NewWriteBatch()
+		if err := applyOps(ops, batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = nob.Write(batch)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// opWriter is an engine.WriteBatch or engine.Txn
+type opWriter interface {
+	Set(key, val string)
+	Delete(key string)
+}
+
+// applyOps(ops, w) validates every op before handing any of them to w
+func applyOps(ops []batchOp, w opWriter) error {
+	for i, op := range ops {
+		if op.Op != "set" && op.Op != "del" {
+			return fmt.Errorf("op %v: unknown op %q", i, op.Op)
+		}
+	}
+	for _, op := range ops {
+		if op.Op == "set" {
+			w.Set(op.Key, op.Value)
+		} else {
+			w.Delete(op.Key)
+		}
+	}
+	return nil
+}
+
+// TXN_TTL is how long a transaction begun over http stays open, it's rolled back after
+const TXN_TTL = 30 * time.Second
+
+// txnRegistry holds the transactions begun over http by id, until they are committed,
+// rolled back or expire
+type txnRegistry struct {
+	mu     sync.Mutex
+	lastID uint64
+	txns   map[uint64]*openTxn
+	ttl    time.Duration
+}
+
+// openTxn guards txn, which isn't safe for concurrent use
+type openTxn struct {
+	mu    sync.Mutex
+	txn   *engine.Txn
+	timer *time.Timer
+}
+
+func newTxnRegistry(ttl time.Duration) *txnRegistry {
+	return &txnRegistry{txns: map[uint64]*openTxn{}, ttl: ttl}
+}
+
+// begin(nob) starts a transaction that's rolled back unless it's done within the ttl,
+// returning its id
+func (reg *txnRegistry) begin(nob *engine.Nob) uint64 {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.lastID++
+	id := reg.lastID
+	o := &openTxn{txn: nob.Begin()}
+	o.timer = time.AfterFunc(reg.ttl, func() {
+		// unless it was taken to be finished already
+		if reg.take(id) != nil {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			o.txn.Rollback()
+		}
+	})
+	reg.txns[id] = o
+	return id
+}
+
+// get(id) returns the open transaction id, nil if there is none
+func (reg *txnRegistry) get(id uint64) *openTxn {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.txns[id]
+}
+
+// take(id) removes the open transaction id for the caller to finish, nil if there is none
+func (reg *txnRegistry) take(id uint64) *openTxn {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	o := reg.txns[id]
+	if o != nil {
+		o.timer.Stop()
+		delete(reg.txns, id)
+	}
+	return o
+}
+
+// txnID(w, r) reads ?txn=, writing 400 if it isn't an id
+func txnID(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("txn"), 10, 64)
+	if err != nil {
+		http.Error(w, "txn: "+err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// noTxn writes 410 Gone for a transaction that's done, expired or never began
+func noTxn(w http.ResponseWriter) {
+	http.Error(w, "no open transaction", http.StatusGone)
+}
+
+// BeginHandler starts a transaction reading the database as of now, writing its id.
+// It's rolled back unless committed within TXN_TTL.
+func BeginHandler(nob *engine.Nob, txns *txnRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := fmt.Fprintf(w, "%v\n", txns.begin(nob))
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// TxnGetHandler reads a key in the transaction ?txn=, as of its beginning or as written
+// by it. Keys read conflict with writes made to them before the commit.
+func TxnGetHandler(txns *txnRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, _ := strings.CutPrefix(r.URL.EscapedPath(), "/txn/get/")
+		id, ok := txnID(w, r)
+		if !ok {
+			return
+		}
+		o := txns.get(id)
+		if o == nil {
+			noTxn(w)
+			return
+		}
+		o.mu.Lock()
+		val, err := o.txn.Get(key)
+		o.mu.Unlock()
+		if err == engine.ErrTxnDone {
+			noTxn(w)
+			return
+		}
+		if err == engine.ErrKeyNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, engine.ErrMergeFailed) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		_, err = fmt.Fprintf(w, "val for %v is %v", key, val)
 		if err != nil {
@@ -52,6 +495,87 @@ func GetHandler(nob *engine.Nob) http.HandlerFunc {
 	}
 }
 
+// txnCommit is the body of POST /txn/commit?txn=, the ops the transaction writes
+type txnCommit struct {
+	Ops []batchOp `json:"ops"`
+}
+
+// CommitHandler applies the ops of the transaction ?txn= atomically, e.g.
+//
+//	{"ops": [{"op": "set", "key": "counter", "value": "42"}]}
+//
+// It fails with 409 Conflict if a key the transaction read was written since it began,
+// and with 410 Gone if it's no longer open. The transaction is done either way.
+func CommitHandler(txns *txnRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := txnID(w, r)
+		if !ok {
+			return
+		}
+		var commit txnCommit
+		err := json.NewDecoder(r.Body).Decode(&commit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		o := txns.take(id)
+		if o == nil {
+			noTxn(w)
+			return
+		}
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if err := applyOps(commit.Ops, o.txn); err != nil {
+			o.txn.Rollback()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = o.txn.Commit()
+		if err == engine.ErrConflict {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RollbackHandler discards the transaction ?txn=
+func RollbackHandler(txns *txnRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := txnID(w, r)
+		if !ok {
+			return
+		}
+		o := txns.take(id)
+		if o == nil {
+			noTxn(w)
+			return
+		}
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.txn.Rollback()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// StatsHandler writes "name value" lines describing the memtables & write sequence
+func StatsHandler(nob *engine.Nob) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := nob.Stats()
+		_, err := fmt.Fprintf(w, "memtable_bytes %v\nmemtable_entries %v\nmemtable_budget %v\nfrozen_memtables %v\nfrozen_bytes %v\nfrozen_entries %v\nlast_sequence %v\n",
+			s.MemtableBytes, s.MemtableEntries, s.MemtableBudget, s.FrozenMemtables, s.FrozenBytes, s.FrozenEntries, s.LastSequence)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Received request: ", r.URL)
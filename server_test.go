@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"git.target.com/eric.miranda/mydb/v2/src/engine"
+)
+
+func getNob(t *testing.T) *engine.Nob {
+	nob := engine.NewNob(t.TempDir())
+	t.Cleanup(func() {
+		_ = nob.Close()
+	})
+	return nob
+}
+
+// serve(h, method, target, body) runs a single request through h
+func serve(h http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestDeleteIgnoresTheQuery(t *testing.T) {
+	nob := getNob(t)
+	_ = nob.Set("k", "v")
+
+	if w := serve(DeleteHandler(nob), "DELETE", "/del/k?x=1", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("got %v", w.Code)
+	}
+	if got, err := nob.Get("k"); err != engine.ErrKeyNotFound {
+		t.Fatalf("k still there: %v %v", got, err)
+	}
+}
+
+func TestIncrOfAWord(t *testing.T) {
+	nob := getNob(t)
+	_ = nob.Set("a", "1")
+	_ = nob.Set("ctr", "abc")
+
+	if w := serve(IncrHandler(nob), "POST", "/incr/ctr", "abc"); w.Code != http.StatusBadRequest {
+		t.Fatalf("got %v", w.Code)
+	}
+	// the value isn't read by the increment, only by reads of ctr
+	if w := serve(IncrHandler(nob), "POST", "/incr/ctr", "1"); w.Code != http.StatusNoContent {
+		t.Fatalf("got %v", w.Code)
+	}
+	if w := serve(GetHandler(nob), "GET", "/get/ctr", ""); w.Code != http.StatusConflict {
+		t.Fatalf("got %v %q", w.Code, w.Body.String())
+	}
+	w := serve(ScanHandler(nob), "GET", "/scan", "")
+	if w.Code != http.StatusOK || w.Body.String() != "a 1\n" {
+		t.Fatalf("got %v %q", w.Code, w.Body.String())
+	}
+	if got := w.Result().Trailer.Get("Skipped-Keys"); got != "ctr" {
+		t.Fatalf("skipped %q", got)
+	}
+}
+
+func TestTxnOverHTTP(t *testing.T) {
+	nob := getNob(t)
+	txns := newTxnRegistry(TXN_TTL)
+	_ = nob.Set("x", "1")
+	begin := func() string {
+		return strings.TrimSpace(serve(BeginHandler(nob, txns), "POST", "/txn/begin", "").Body.String())
+	}
+	set := `{"ops": [{"op": "set", "key": "x", "value": "mine"}]}`
+
+	id := begin()
+	_ = nob.Set("x", "2")
+	if w := serve(TxnGetHandler(txns), "GET", "/txn/get/x?txn="+id, ""); w.Body.String() != "val for x is 1" {
+		t.Fatalf("got %v %q", w.Code, w.Body.String())
+	}
+	if w := serve(CommitHandler(txns), "POST", "/txn/commit?txn="+id, set); w.Code != http.StatusConflict {
+		t.Fatalf("got %v", w.Code)
+	}
+	if w := serve(CommitHandler(txns), "POST", "/txn/commit?txn="+id, set); w.Code != http.StatusGone {
+		t.Fatalf("second commit got %v", w.Code)
+	}
+
+	id = begin()
+	serve(TxnGetHandler(txns), "GET", "/txn/get/x?txn="+id, "")
+	if w := serve(CommitHandler(txns), "POST", "/txn/commit?txn="+id, set); w.Code != http.StatusNoContent {
+		t.Fatalf("got %v", w.Code)
+	}
+	if got, _ := nob.Get("x"); got != "mine" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestTxnsExpire(t *testing.T) {
+	nob := getNob(t)
+	txns := newTxnRegistry(10 * time.Millisecond)
+	id := strings.TrimSpace(serve(BeginHandler(nob, txns), "POST", "/txn/begin", "").Body.String())
+
+	time.Sleep(50 * time.Millisecond)
+	if w := serve(TxnGetHandler(txns), "GET", "/txn/get/x?txn="+id, ""); w.Code != http.StatusGone {
+		t.Fatalf("got %v", w.Code)
+	}
+	if w := serve(CommitHandler(txns), "POST", "/txn/commit?txn="+id, `{"ops": []}`); w.Code != http.StatusGone {
+		t.Fatalf("got %v", w.Code)
+	}
+}
+
+func TestGetRejectsFutureSequences(t *testing.T) {
+	nob := getNob(t)
+	_ = nob.Set("x", "1")
+	if w := serve(GetHandler(nob), "GET", "/get/x?seq=2", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("got %v", w.Code)
+	}
+}
+
+// noCompactions leaves the segments written by flushes as they are
+type noCompactions struct{}
+
+func (noCompactions) Pick(*engine.Levels) *engine.Compaction { return nil }
+func (noCompactions) Full(*engine.Levels) *engine.Compaction { return nil }
+
+func TestScanOverHTTP(t *testing.T) {
+	nob := getNob(t)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		_ = nob.Set(k, "val "+k)
+	}
+
+	w := serve(ScanHandler(nob), "GET", "/scan?start=b&limit=2", "")
+	if w.Code != http.StatusOK || w.Body.String() != "b val b\nc val c\n" {
+		t.Fatalf("got %v %q", w.Code, w.Body.String())
+	}
+	if w := serve(ScanHandler(nob), "GET", "/scan?start=c&end=d", ""); w.Body.String() != "c val c\n" {
+		t.Fatalf("got %v %q", w.Code, w.Body.String())
+	}
+	if w := serve(ScanHandler(nob), "GET", "/scan?limit=-1", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("got %v", w.Code)
+	}
+}
+
+func TestScanAbortsOnACorruptSegment(t *testing.T) {
+	tdir := t.TempDir()
+	opts := engine.DefaultOptions()
+	opts.MemtableSize = 1 << 10
+	opts.BlockSize = 64
+	opts.Strategy = noCompactions{}
+	nob, err := engine.NewNobWithOptions(tdir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 60 {
+		_ = nob.Set(fmt.Sprintf("key%02d", i), strings.Repeat("v", 40))
+	}
+	// the flushes are waited for
+	_ = nob.Close()
+
+	// flip a bit in the crc of the last data block of every segment, the first ones still read
+	entries, err := os.ReadDir(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := 0
+	for _, e := range entries {
+		segPath := path.Join(tdir, e.Name())
+		b, err := os.ReadFile(segPath)
+		if err != nil || len(b) < engine.FOOTER_SIZE || binary.LittleEndian.Uint32(b[len(b)-4:]) != engine.SSTABLE_MAGIC {
+			continue
+		}
+		indexOffset := binary.LittleEndian.Uint64(b[len(b)-engine.FOOTER_SIZE:])
+		b[indexOffset-1] ^= 0x01
+		if err := os.WriteFile(segPath, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		corrupted++
+	}
+	if corrupted == 0 {
+		t.Fatal("wanted segments")
+	}
+
+	nob, err = engine.NewNobWithOptions(tdir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nob.Close()
+	w := httptest.NewRecorder()
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Fatalf("got %v want the response aborted", r)
+			}
+		}()
+		ScanHandler(nob)(w, httptest.NewRequest("GET", "/scan", nil))
+	}()
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "key00 ") {
+		t.Fatalf("got %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestBatchOverHTTP(t *testing.T) {
+	nob := getNob(t)
+	_ = nob.Set("baz", "old")
+
+	body := `[{"op": "set", "key": "foo", "value": "bar"}, {"op": "del", "key": "baz"}]`
+	if w := serve(BatchHandler(nob), "POST", "/batch", body); w.Code != http.StatusNoContent {
+		t.Fatalf("got %v %q", w.Code, w.Body.String())
+	}
+	if got, err := nob.Get("foo"); err != nil || got != "bar" {
+		t.Fatalf("foo got %v %v", got, err)
+	}
+	if got, err := nob.Get("baz"); err != engine.ErrKeyNotFound {
+		t.Fatalf("baz got %v %v", got, err)
+	}
+
+	// nothing is written when an op is bad, even the ones before it
+	for _, body := range []string{
+		`[{"op": "set", "key": "a", "value": "1"}, {"op": "incr", "key": "b"}]`,
+		`[{"op": "set", "key": "a", "value": "1"}`,
+		`{"op": "set", "key": "a", "value": "1"}`,
+	} {
+		if w := serve(BatchHandler(nob), "POST", "/batch", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("%v got %v", body, w.Code)
+		}
+		if got, err := nob.Get("a"); err != engine.ErrKeyNotFound {
+			t.Fatalf("%v wrote a: %v %v", body, got, err)
+		}
+	}
+}
+
+// setWith(nob, target, body, header) runs a POST /set/ with a header, as "Name: value"
+func setWith(nob *engine.Nob, target, body string, header ...string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	for _, h := range header {
+		name, value, _ := strings.Cut(h, ": ")
+		r.Header.Set(name, value)
+	}
+	SetHandler(nob)(w, r)
+	return w
+}
+
+func TestConditionalSetOverHTTP(t *testing.T) {
+	nob := getNob(t)
+
+	w := setWith(nob, "/set/k", "1", "If-None-Match: *")
+	created := w.Header().Get("ETag")
+	if w.Code != http.StatusCreated || created == "" {
+		t.Fatalf("got %v etag %q", w.Code, created)
+	}
+	if w := setWith(nob, "/set/k", "2", "If-None-Match: *"); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("got %v", w.Code)
+	}
+	if w := serve(GetHandler(nob), "GET", "/get/k", ""); w.Header().Get("ETag") != created {
+		t.Fatalf("got etag %q want %q", w.Header().Get("ETag"), created)
+	}
+
+	w = setWith(nob, "/set/k", "3", "If-Match: "+created)
+	updated := w.Header().Get("ETag")
+	if w.Code != http.StatusCreated || updated == "" || updated == created {
+		t.Fatalf("got %v etag %q", w.Code, updated)
+	}
+	// the version read before the update is stale
+	if w := setWith(nob, "/set/k", "4", "If-Match: "+created); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("got %v", w.Code)
+	}
+	if w := setWith(nob, "/set/k", "5", "If-Match: *"); w.Code != http.StatusCreated {
+		t.Fatalf("got %v", w.Code)
+	}
+	if w := setWith(nob, "/set/missing", "1", "If-Match: *"); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("got %v", w.Code)
+	}
+	if got, err := nob.Get("k"); err != nil || got != "5" {
+		t.Fatalf("got %v %v", got, err)
+	}
+
+	for _, header := range [][]string{
+		{"If-Match: 7"},
+		{"If-None-Match: " + updated},
+		{"If-Match: *", "If-None-Match: *"},
+	} {
+		if w := setWith(nob, "/set/k", "6", header...); w.Code != http.StatusBadRequest {
+			t.Fatalf("%v got %v", header, w.Code)
+		}
+	}
+	if got, err := nob.Get("k"); err != nil || got != "5" {
+		t.Fatalf("got %v %v", got, err)
+	}
+}
+
+func TestTTLOverHTTP(t *testing.T) {
+	nob := getNob(t)
+
+	if w := setWith(nob, "/set/a?ttl=1h", "1"); w.Code != http.StatusCreated {
+		t.Fatalf("got %v", w.Code)
+	}
+	if w := setWith(nob, "/set/b", "1", "TTL: 90"); w.Code != http.StatusCreated {
+		t.Fatalf("got %v", w.Code)
+	}
+	_ = nob.Set("c", "1")
+	for key, want := range map[string]string{"a": "3600\n", "b": "90\n", "c": "-1\n"} {
+		if w := serve(TTLHandler(nob), "GET", "/ttl/"+key, ""); w.Code != http.StatusOK || w.Body.String() != want {
+			t.Fatalf("%v got %v %q want %q", key, w.Code, w.Body.String(), want)
+		}
+	}
+	if w := serve(TTLHandler(nob), "GET", "/ttl/missing", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("got %v", w.Code)
+	}
+
+	for _, w := range []*httptest.ResponseRecorder{
+		setWith(nob, "/set/d?ttl=soon", "1"),
+		setWith(nob, "/set/d", "1", "TTL: 0"),
+		setWith(nob, "/set/d?ttl=1h", "1", "If-Match: *"),
+		setWith(nob, "/set/d", "1", "TTL: 1h", "If-None-Match: *"),
+	} {
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got %v", w.Code)
+		}
+	}
+	if got, err := nob.Get("d"); err != engine.ErrKeyNotFound {
+		t.Fatalf("d got %v %v", got, err)
+	}
+}
+
+func TestStatsOverHTTP(t *testing.T) {
+	nob := getNob(t)
+	_ = nob.Set("a", "1")
+	_ = nob.Set("b", "2")
+
+	w := serve(StatsHandler(nob), "GET", "/stats", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %v", w.Code)
+	}
+	stats := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+		name, value, ok := strings.Cut(line, " ")
+		if !ok {
+			t.Fatalf("bad line %q", line)
+		}
+		stats[name] = value
+	}
+	s := nob.Stats()
+	want := map[string]string{
+		"memtable_bytes":   fmt.Sprint(s.MemtableBytes),
+		"memtable_entries": "2",
+		"memtable_budget":  fmt.Sprint(engine.DefaultOptions().MemtableSize),
+		"frozen_memtables": "0",
+		"frozen_bytes":     "0",
+		"frozen_entries":   "0",
+		"last_sequence":    "2",
+	}
+	if !maps.Equal(stats, want) {
+		t.Fatalf("got %v want %v", stats, want)
+	}
+}
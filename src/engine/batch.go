@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"encoding/binary"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+// WriteBatch collects puts, deletes & merges that Write applies atomically.
+// Later entries for a key win over earlier ones, as if applied in order.
+type WriteBatch struct {
+	// entries hold marked memtable values
+	entries []util.Entry
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Set(key, val string) {
+	b.entries = append(b.entries, util.Entry{Key: key, Value: string(VALUE_MARKER) + val})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, util.Entry{Key: key, Value: string(TOMBSTONE_MARKER)})
+}
+
+// Len() returns the number of puts, deletes & merges in b
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// GROUP_COMMIT_SIZE bounds the bytes of pending batches a writer commits along with its own
+const GROUP_COMMIT_SIZE = 1 << 20
+
+// pendingWrite is a batch queued for the next group commit
+type pendingWrite struct {
+	batch *WriteBatch
+	// done & err are set by whichever writer commits batch, with writeMu held
+	done bool
+	err  error
+}
+
+// Write(b) applies every entry of b or, on error, none of them.
+//
+// b is a single wal record, so a crash can't replay part of it, and its entries are
+// inserted into the memtable together, which is only frozen after the last one, so
+// readers and flushes never see half of b. Entries take consecutive sequence numbers,
+// made visible to reads all at once.
+//
+// Writers are serialised by writeMu, held across the wal sync. Batches written meanwhile
+// queue up & whoever takes writeMu next commits all of them, up to GROUP_COMMIT_SIZE,
+// with a single sync.
+func (nob *Nob) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	if err := nob.checkOperands(b); err != nil {
+		return err
+	}
+	w := &pendingWrite{batch: b}
+	nob.pendingMu.Lock()
+	nob.pending = append(nob.pending, w)
+	nob.pendingMu.Unlock()
+
+	nob.writeMu.Lock()
+	defer nob.writeMu.Unlock()
+	for !w.done {
+		nob.commit(nob.takePending(nil))
+	}
+	return w.err
+}
+
+// write(b) commits b ahead of the pending batches, call with writeMu held
+func (nob *Nob) write(b *WriteBatch) error {
+	w := &pendingWrite{batch: b}
+	nob.commit(nob.takePending(w))
+	return w.err
+}
+
+// takePending(first) returns first, if not nil, followed by the oldest pending batches,
+// at least one, up to GROUP_COMMIT_SIZE
+func (nob *Nob) takePending(first *pendingWrite) []*pendingWrite {
+	var group []*pendingWrite
+	var size int
+	if first != nil {
+		group, size = append(group, first), first.batch.size()
+	}
+	nob.pendingMu.Lock()
+	defer nob.pendingMu.Unlock()
+	for len(nob.pending) > 0 {
+		next := nob.pending[0].batch.size()
+		if len(group) > 0 && size+next > GROUP_COMMIT_SIZE {
+			break
+		}
+		group, size = append(group, nob.pending[0]), size+next
+		nob.pending = nob.pending[1:]
+	}
+	return group
+}
+
+// commit(group) writes the batches of group as one wal record, call with writeMu held
+func (nob *Nob) commit(group []*pendingWrite) {
+	var entries []util.Entry
+	for _, w := range group {
+		entries = append(entries, w.batch.entries...)
+	}
+	err := nob.insertAll(entries)
+	for _, w := range group {
+		w.done, w.err = true, err
+	}
+}
+
+// insertAll(entries) logs entries and inserts them into the memtable
+func (nob *Nob) insertAll(entries []util.Entry) error {
+	// lastSeq & memtable only change with writeMu held
+	seq := nob.lastSeq.Load() + 1
+	if err := nob.wal.append(seq, entries); err != nil {
+		return err
+	}
+	// a concurrent memtable doesn't need readers kept out, see lookupVersion
+	unlocked := nob.memtable.Concurrent()
+	if !unlocked {
+		nob.mu.Lock()
+	}
+	for i, e := range entries {
+		nob.insert(nob.memtable, e.Key, seq+uint64(i), e.Value)
+	}
+	nob.lastSeq.Store(seq + uint64(len(entries)) - 1)
+	full := int64(nob.memtable.GetSize()) > nob.opts.MemtableSize
+	if !unlocked {
+		nob.mu.Unlock()
+	}
+
+	if full {
+		nob.freezeMemtable()
+	}
+	return nil
+}
+
+// size() estimates the bytes b takes in the wal
+func (b *WriteBatch) size() int {
+	var size int
+	for _, e := range b.entries {
+		size += len(e.Key) + len(e.Value) + 2*binary.MaxVarintLen64
+	}
+	return size
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestWriteBatchAppliesPutsAndDeletes(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	_ = nob.Set("gone", "soon")
+
+	b := NewWriteBatch()
+	b.Set("foo", "bar")
+	b.Set("baz", "first")
+	b.Set("baz", "second")
+	b.Delete("gone")
+	if err := nob.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(nob *Nob) {
+		t.Helper()
+		for key, want := range map[string]string{"foo": "bar", "baz": "second"} {
+			if got, err := nob.Get(key); err != nil || got != want {
+				t.Fatalf("%v got %v %v want %v", key, got, err, want)
+			}
+		}
+		if _, err := nob.Get("gone"); err != ErrKeyNotFound {
+			t.Fatalf("got %v want %v", err, ErrKeyNotFound)
+		}
+	}
+	check(nob)
+	_ = nob.Close()
+	check(getNob(t, tdir))
+}
+
+func TestTornBatchIsDroppedWhole(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	_ = nob.Set("before", "batch")
+	info, err := os.Stat(path.Join(tdir, WAL_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewWriteBatch()
+	b.Set("foo", "bar")
+	b.Set("baz", "qux")
+	_ = nob.Write(b)
+	_ = nob.Close()
+
+	// a crash after the first entry of the batch hit the disk
+	walPath := path.Join(tdir, WAL_NAME)
+	full, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(walPath, info.Size()+(full.Size()-info.Size())/2); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := getNob(t, tdir)
+	if got, err := restarted.Get("before"); err != nil || got != "batch" {
+		t.Fatalf("got %v %v", got, err)
+	}
+	for _, key := range []string{"foo", "baz"} {
+		if _, err := restarted.Get(key); err != ErrKeyNotFound {
+			t.Fatalf("%v of a torn batch got %v", key, err)
+		}
+	}
+}
+
+func TestBatchIsNeverSplitAcrossSegments(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	// the memtable is nearly full when the batch arrives
+	for i := range 5 {
+		_ = nob.Set(fmt.Sprintf("pre%v", i), "val")
+	}
+	b := NewWriteBatch()
+	for i := range 20 {
+		b.Set(fmt.Sprintf("batch%02d", i), "val")
+	}
+	_ = nob.Write(b)
+	nob.waitForFlushes()
+
+	holders := map[string]bool{}
+	for _, f := range nob.currentVersion().all() {
+		table, err := openSSTable(path.Join(tdir, f.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		it := table.iterator("batch")
+		for it.next() && userKeyOf(it.key()) < "batcj" {
+			holders[f.name] = true
+		}
+		it.close()
+		table.close()
+	}
+	if len(holders) != 1 {
+		t.Fatalf("batch landed in %v segments", holders)
+	}
+}
+
+func TestReadersNeverSeeHalfABatch(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 200 {
+			b := NewWriteBatch()
+			b.Set("left", fmt.Sprint(i))
+			b.Set("right", fmt.Sprint(i))
+			_ = nob.Write(b)
+		}
+	}()
+	for range 200 {
+		got := collect(nob.Scan("left", ""))
+		if got["left"] != got["right"] {
+			t.Fatalf("saw half a batch: %v", got)
+		}
+	}
+	wg.Wait()
+}
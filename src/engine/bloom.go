@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+const DEFAULT_BLOOM_FP_RATE = 0.01
+
+func bloomNameOf(segName string) string {
+	return fmt.Sprintf("bloom_%v", segName)
+}
+
+// writeBloomFile(bloomPath, hashes, fpRate) persists a filter over hashes next to its segment
+func writeBloomFile(bloomPath string, hashes []uint64, fpRate float64) *util.BloomFilter {
+	bf := util.NewBloomFilter(hashes, fpRate)
+	data, _ := bf.MarshalBinary()
+
+	f, err := os.Create(bloomPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func(f *os.File) {
+		err := f.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}(f)
+	_, err = f.Write(data)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return bf
+}
+
+// loadBloom(segName) reads the filter of segName, or nil if it has none
+// (segments written before bloom filters existed)
+func (nob *Nob) loadBloom(segName string) (*util.BloomFilter, error) {
+	data, err := os.ReadFile(path.Join(nob.rootDir, bloomNameOf(segName)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bf := &util.BloomFilter{}
+	if err := bf.UnmarshalBinary(data); err != nil {
+		log.Println("ignoring corrupt bloom filter of", segName, err)
+		return nil, nil
+	}
+	return bf, nil
+}
+
+// mayContain(key) is false if the segment definitely doesn't hold key
+func (f *fileMeta) mayContain(key string) bool {
+	return f.bloom == nil || f.bloom.MayContain(key)
+}
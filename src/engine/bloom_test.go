@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+func TestBloomSkipsSegmentsOnMiss(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNobWithStrategy(t, tdir, NewSizeTieredStrategy())
+	for i := range 500 {
+		_ = nob.Set(fmt.Sprintf("key%04d", i), "val")
+	}
+	_ = nob.Close()
+	// filters come back from their sidecar files
+	nob = getNobWithStrategy(t, tdir, NewSizeTieredStrategy())
+
+	files := nob.currentVersion().all()
+	if len(files) < 2 {
+		t.Fatal("wanted several segments")
+	}
+
+	var probes, falsePositives int
+	for i := range 2000 {
+		key := fmt.Sprintf("absent%04d", i)
+		for _, f := range files {
+			probes++
+			if f.mayContain(key) {
+				falsePositives++
+			}
+		}
+	}
+	// default rate is 1%, leave plenty of room for variance
+	if rate := float64(falsePositives) / float64(probes); rate > 0.05 {
+		t.Fatalf("false positive rate %v", rate)
+	}
+
+	for i := range 500 {
+		key := fmt.Sprintf("key%04d", i)
+		got, err := nob.Get(key)
+		if err != nil || got != "val" {
+			t.Fatalf("key %v got %v %v", key, got, err)
+		}
+	}
+}
+
+func TestBloomFalsePositiveRateIsConfigurable(t *testing.T) {
+	firstBloom := func(rate float64) *util.BloomFilter {
+		opts := testOptions(testLeveledStrategy())
+		opts.BloomFalsePositiveRate = rate
+		nob := getNobWithOptions(t, t.TempDir(), opts)
+		// compactions would rewrite the segments with their own filters
+		nob.compactMu.Lock()
+		defer nob.compactMu.Unlock()
+		for i := range 20 {
+			_ = nob.Set(fmt.Sprintf("key%04d", i), "val")
+		}
+		nob.waitForFlushes()
+		return nob.currentVersion().levels[0][0].bloom
+	}
+	loose := firstBloom(0.5)
+	tight := firstBloom(0.0001)
+
+	looseBits, _ := loose.MarshalBinary()
+	tightBits, _ := tight.MarshalBinary()
+	if len(tightBits) <= len(looseBits) {
+		t.Fatalf("tighter rate should use more bits, got %v <= %v", len(tightBits), len(looseBits))
+	}
+}
@@ -0,0 +1,525 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+// CompactionStrategy decides which live files get merged next.
+// The scheduler asks it for work after every flush. A strategy may be shared by
+// several Nobs, anything it remembers between picks belongs in Levels.
+type CompactionStrategy interface {
+	// Pick(levels) returns the most urgent compaction, or nil if levels need none
+	Pick(levels *Levels) *Compaction
+	// Full(levels) returns a compaction of all of L0, or nil if L0 is empty
+	Full(levels *Levels) *Compaction
+}
+
+// FileInfo describes a live segment file to a CompactionStrategy
+type FileInfo struct {
+	Name  string
+	Level int
+	Size  int64
+	// Smallest & Largest bound the keys the file holds
+	Smallest string
+	Largest  string
+}
+
+// Levels are the live files of a Nob by level. L0 holds memtable flushes, which may
+// overlap, newest first. L1..Ln each hold non-overlapping files sorted by key, every
+// level older than the one above it.
+type Levels struct {
+	Files [NUM_LEVELS][]FileInfo
+	// CompactPointer holds, by level, the largest key of the last compaction out of
+	// that level into the next, so compactions can round-robin through its keys
+	CompactPointer [NUM_LEVELS]string
+}
+
+// LevelSize(level) is the bytes held by the files of level
+func (l *Levels) LevelSize(level int) int64 {
+	var size int64
+	for _, f := range l.Files[level] {
+		size += f.Size
+	}
+	return size
+}
+
+// Overlapping(level, smallest, largest) returns the files of level intersecting [smallest, largest]
+func (l *Levels) Overlapping(level int, smallest, largest string) []FileInfo {
+	var res []FileInfo
+	for _, f := range l.Files[level] {
+		if f.Smallest <= largest && smallest <= f.Largest {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// Compaction merges Inputs (newest first) into files of at most MaxFileSize
+// (0 for a single file) in OutputLevel
+type Compaction struct {
+	Inputs      []FileInfo
+	OutputLevel int
+	MaxFileSize int64
+}
+
+// compaction is a Compaction of the files of a version
+type compaction struct {
+	inputs      []*fileMeta
+	outputLevel int
+	maxFileSize int64
+}
+
+// levelsOf(v) describes v to the strategy, call with compactMu held
+func (nob *Nob) levelsOf(v *version) *Levels {
+	l := &Levels{CompactPointer: nob.compactPointer}
+	for level, files := range v.levels {
+		for _, f := range files {
+			l.Files[level] = append(l.Files[level], FileInfo{Name: f.name, Level: level, Size: f.size, Smallest: f.smallest, Largest: f.largest})
+		}
+	}
+	return l
+}
+
+// resolve(v, c) returns the compaction of the files of v that c names. It fails if c
+// names a file that isn't live in v, or would leave overlapping files below L0.
+func resolve(v *version, c *Compaction) (*compaction, error) {
+	if len(c.Inputs) == 0 || c.OutputLevel < 0 || c.OutputLevel >= NUM_LEVELS {
+		return nil, fmt.Errorf("bad compaction into level %v of %v files", c.OutputLevel, len(c.Inputs))
+	}
+	live := map[string]*fileMeta{}
+	for _, f := range v.all() {
+		live[f.name] = f
+	}
+	res := &compaction{outputLevel: c.OutputLevel, maxFileSize: c.MaxFileSize}
+	inputs := map[string]bool{}
+	for _, in := range c.Inputs {
+		f, ok := live[in.Name]
+		if !ok || inputs[in.Name] {
+			return nil, fmt.Errorf("compaction input %v isn't a live file", in.Name)
+		}
+		if f.level > c.OutputLevel {
+			return nil, fmt.Errorf("compaction of %v in level %v into level %v", f.name, f.level, c.OutputLevel)
+		}
+		inputs[in.Name] = true
+		res.inputs = append(res.inputs, f)
+	}
+	if c.OutputLevel > 0 {
+		smallest, largest := keyRange(res.inputs)
+		for _, f := range v.overlapping(c.OutputLevel, smallest, largest) {
+			if !inputs[f.name] {
+				return nil, fmt.Errorf("compaction output would overlap %v in level %v", f.name, c.OutputLevel)
+			}
+		}
+	}
+	return res, nil
+}
+
+// pickCompaction(full) asks the strategy for its next compaction, or for a full one.
+// Call with compactMu held.
+func (nob *Nob) pickCompaction(full bool) *compaction {
+	v := nob.currentVersion()
+	var c *Compaction
+	if full {
+		c = nob.opts.Strategy.Full(nob.levelsOf(v))
+	} else {
+		c = nob.opts.Strategy.Pick(nob.levelsOf(v))
+	}
+	if c == nil {
+		return nil
+	}
+	res, err := resolve(v, c)
+	if err != nil {
+		log.Println("ignoring compaction:", err)
+		return nil
+	}
+	return res
+}
+
+// LeveledStrategy keeps L1..Ln non-overlapping, each level levelMultiplier times
+// bigger than the one above. A Get reads at most one file per level below L0.
+type LeveledStrategy struct {
+	// L0Trigger is the number of L0 files that starts an L0 -> L1 compaction
+	L0Trigger       int
+	LevelBaseSize   int64
+	LevelMultiplier int64
+	MaxFileSize     int64
+}
+
+func NewLeveledStrategy() *LeveledStrategy {
+	return &LeveledStrategy{L0Trigger: 4, LevelBaseSize: 10 << 20, LevelMultiplier: 10, MaxFileSize: 2 << 20}
+}
+
+// levelTarget(level) is the size a level may grow to before it is compacted into the next
+func (s *LeveledStrategy) levelTarget(level int) int64 {
+	target := s.LevelBaseSize
+	for i := 1; i < level; i++ {
+		target *= s.LevelMultiplier
+	}
+	return target
+}
+
+// Pick(levels) compacts L0 once it holds L0Trigger files, as every one of them is read on a miss.
+// Otherwise the level furthest over its target has one file pushed down a level,
+// so a single compaction only ever touches a small slice of the database.
+func (s *LeveledStrategy) Pick(levels *Levels) *Compaction {
+	if len(levels.Files[0]) >= s.L0Trigger {
+		return s.Full(levels)
+	}
+
+	bestLevel, bestScore := -1, 1.0
+	for level := 1; level < NUM_LEVELS-1; level++ {
+		score := float64(levels.LevelSize(level)) / float64(s.levelTarget(level))
+		if score > bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+	if bestLevel == -1 {
+		return nil
+	}
+
+	file := s.pickFile(levels, bestLevel)
+	inputs := append([]FileInfo{file}, levels.Overlapping(bestLevel+1, file.Smallest, file.Largest)...)
+	return &Compaction{Inputs: inputs, OutputLevel: bestLevel + 1, MaxFileSize: s.MaxFileSize}
+}
+
+// Full(levels) merges all of L0 with the L1 files it overlaps
+func (s *LeveledStrategy) Full(levels *Levels) *Compaction {
+	l0 := levels.Files[0]
+	if len(l0) == 0 {
+		return nil
+	}
+	smallest, largest := l0[0].Smallest, l0[0].Largest
+	for _, f := range l0[1:] {
+		smallest = min(smallest, f.Smallest)
+		largest = max(largest, f.Largest)
+	}
+	inputs := append(append([]FileInfo{}, l0...), levels.Overlapping(1, smallest, largest)...)
+	return &Compaction{Inputs: inputs, OutputLevel: 1, MaxFileSize: s.MaxFileSize}
+}
+
+// pickFile(levels, level) round-robins through the key space of level from its
+// compact pointer, so every file eventually gets pushed down
+func (s *LeveledStrategy) pickFile(levels *Levels, level int) FileInfo {
+	files := levels.Files[level]
+	for _, f := range files {
+		if f.Smallest > levels.CompactPointer[level] {
+			return f
+		}
+	}
+	return files[0]
+}
+
+// SizeTieredStrategy keeps every file in L0 and merges runs of similarly sized
+// files into one bigger tier. Writes are rewritten fewer times than with
+// LeveledStrategy, at the cost of reads consulting more files.
+type SizeTieredStrategy struct {
+	// MinThreshold similar files make a tier worth merging, at most MaxThreshold at once
+	MinThreshold int
+	MaxThreshold int
+	// a file joins a tier if its size is within [BucketLow, BucketHigh] x the tier's average
+	BucketLow  float64
+	BucketHigh float64
+}
+
+func NewSizeTieredStrategy() *SizeTieredStrategy {
+	return &SizeTieredStrategy{MinThreshold: 4, MaxThreshold: 32, BucketLow: 0.5, BucketHigh: 1.5}
+}
+
+// Pick(levels) merges the tier with the smallest files first, as it is the cheapest.
+//
+// Files overlap, so a tier must be a run of files adjacent in age, otherwise the merged
+// file would sit either above or below a file whose versions fall between its inputs.
+func (s *SizeTieredStrategy) Pick(levels *Levels) *Compaction {
+	var best []FileInfo
+	var bestAvg float64
+
+	files := levels.Files[0]
+	for start := 0; start < len(files); {
+		tier := []FileInfo{files[start]}
+		total := float64(files[start].Size)
+		for _, f := range files[start+1:] {
+			avg := total / float64(len(tier))
+			if len(tier) == s.MaxThreshold || float64(f.Size) < avg*s.BucketLow || float64(f.Size) > avg*s.BucketHigh {
+				break
+			}
+			tier = append(tier, f)
+			total += float64(f.Size)
+		}
+
+		avg := total / float64(len(tier))
+		if len(tier) >= s.MinThreshold && (best == nil || avg < bestAvg) {
+			best, bestAvg = tier, avg
+		}
+		start += len(tier)
+	}
+
+	if best == nil {
+		return nil
+	}
+	return &Compaction{Inputs: best, OutputLevel: 0}
+}
+
+// Full(levels) merges all of L0 into a single file
+func (s *SizeTieredStrategy) Full(levels *Levels) *Compaction {
+	if len(levels.Files[0]) == 0 {
+		return nil
+	}
+	return &Compaction{Inputs: append([]FileInfo{}, levels.Files[0]...), OutputLevel: 0}
+}
+
+// runCompaction(c) writes the merged inputs to new files in c.outputLevel and
+// swaps them into the manifest. The inputs are deleted once no reader holds them.
+// It returns false if an input couldn't be read, leaving the inputs live.
+//
+// Call with compactMu held.
+func (nob *Nob) runCompaction(c *compaction) bool {
+	smallest, largest := keyRange(c.inputs)
+	var inputPaths []string
+	for _, f := range c.inputs {
+		inputPaths = append(inputPaths, path.Join(nob.rootDir, f.name))
+	}
+	log.Println("compacting", inputPaths, "into level", c.outputLevel)
+
+	// unless an older version may still live elsewhere, tombstones have nothing left to hide
+	dropTombstones := !nob.hasOlderOverlap(c, smallest, largest)
+	merged := nob.newVersionFilter(nob.mergeFiles(inputPaths), dropTombstones)
+	defer merged.close()
+
+	var outputs []*fileMeta
+	for {
+		segName := fmt.Sprintf("compacted_%v", nob.allocateSeg())
+		meta := nob.writeSegment(segName, c.outputLevel, merged, c.maxFileSize)
+		if meta == nil {
+			break
+		}
+		outputs = append(outputs, meta)
+	}
+	if err := merged.err(); err != nil {
+		// the inputs stay live, the outputs never made it to the manifest
+		log.Println("compaction aborted:", err)
+		for _, f := range outputs {
+			nob.removeSegment(f.name)
+		}
+		return false
+	}
+
+	e := &versionEdit{added: outputs}
+	for _, f := range c.inputs {
+		e.deleted = append(e.deleted, f.name)
+	}
+	nob.logAndApply(e)
+
+	// the next compaction out of a level carries on past these inputs
+	for _, f := range c.inputs {
+		if f.level > 0 && f.level < c.outputLevel {
+			nob.compactPointer[f.level] = max(nob.compactPointer[f.level], f.largest)
+		}
+	}
+	return true
+}
+
+// hasOlderOverlap(c, smallest, largest) reports whether a file not part of c holds keys
+// in range written before the latest write of c's inputs. Files written before sequence
+// numbers may hold anything.
+//
+// Only compactions change L1..Ln and flushes only add newer L0 files, so the
+// answer can't change while compactMu is held.
+func (nob *Nob) hasOlderOverlap(c *compaction, smallest, largest string) bool {
+	v := nob.currentVersion()
+	inputs := map[string]bool{}
+	var inputsSeq uint64
+	for _, f := range c.inputs {
+		inputs[f.name] = true
+		inputsSeq = max(inputsSeq, f.largestSeq)
+	}
+
+	for level := range v.levels {
+		for _, f := range v.overlapping(level, smallest, largest) {
+			if !inputs[f.name] && f.smallestSeq <= inputsSeq {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeSegment(segName, level, records, maxSize) writes records to a new segment until
+// maxSize bytes (0 for no limit). It returns nil if records had nothing left to write.
+func (nob *Nob) writeSegment(segName string, level int, records *versionFilter, maxSize int64) *fileMeta {
+	segPath := path.Join(nob.rootDir, segName+TMP_SUFFIX)
+	segFile, err := os.Create(segPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer func(segfile *os.File) {
+		err := segfile.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}(segFile)
+
+	meta := nob.writeTable(segFile, records, maxSize)
+	if meta == nil {
+		err = os.Remove(segPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = os.Remove(path.Join(nob.rootDir, bloomNameOf(segName)+TMP_SUFFIX))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return nil
+	}
+
+	err = segFile.Sync()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	nob.commitSegment(segName)
+
+	meta.name, meta.level = segName, level
+	return meta
+}
+
+func keyRange(files []*fileMeta) (string, string) {
+	smallest, largest := files[0].smallest, files[0].largest
+	for _, f := range files[1:] {
+		smallest = min(smallest, f.smallest)
+		largest = max(largest, f.largest)
+	}
+	return smallest, largest
+}
+
+// versionFilter drops the versions of a key no read can see anymore. Of the versions
+// in a stripe (see stripeOf) only the newest is kept. With dropTombstones, a tombstone
+// in the oldest stripe is dropped too, as nothing older than it is left to hide.
+//
+// Expired values are tombstones to every read, they're dropped or written as one.
+//
+// Merge operands are folded with the older versions of their stripe, into a value if
+// one of those isn't an operand or nothing older is left, else into one operand. A live
+// expiring value is kept after the operands instead, see foldsInto.
+type versionFilter struct {
+	recordIterator
+	op MergeOperator
+	k  string
+	r  string
+	// queue holds the versions read while folding operands the merge operator failed on,
+	// they're written as they are
+	queue []util.Entry
+	// snapshots live when the filter was made. Snapshots taken later read at least
+	// as new as every input, whose newest versions are always kept.
+	snapshots      []uint64
+	dropTombstones bool
+	lastKey        string
+	lastStripe     int
+	started        bool
+	pushedBack     bool
+	// ahead is set once recordIterator is on a record next() hasn't looked at yet
+	ahead bool
+}
+
+func (nob *Nob) newVersionFilter(records recordIterator, dropTombstones bool) *versionFilter {
+	return &versionFilter{
+		recordIterator: records,
+		op:             nob.opts.MergeOperator,
+		snapshots:      nob.liveSnapshots(),
+		dropTombstones: dropTombstones,
+	}
+}
+
+func (f *versionFilter) next() bool {
+	if f.pushedBack {
+		f.pushedBack = false
+		return true
+	}
+	if len(f.queue) > 0 {
+		f.k, f.r, f.queue = f.queue[0].Key, f.queue[0].Value, f.queue[1:]
+		return true
+	}
+	for f.advance() {
+		f.k = f.recordIterator.key()
+		key, seq := parseInternalKey(f.k)
+		stripe := stripeOf(f.snapshots, seq)
+		if f.started && key == f.lastKey && stripe == f.lastStripe {
+			continue
+		}
+		f.lastKey, f.lastStripe, f.started = key, stripe, true
+		f.r = f.recordIterator.raw()
+		if f.r[0] == MERGE_MARKER {
+			f.fold(key, stripe)
+			return true
+		}
+		if _, live := unmarkValue(f.r); !live {
+			if f.dropTombstones && stripe == 0 {
+				continue
+			}
+			f.r = string(TOMBSTONE_MARKER)
+		}
+		return true
+	}
+	return false
+}
+
+func (f *versionFilter) advance() bool {
+	if f.ahead {
+		f.ahead = false
+		return true
+	}
+	return f.recordIterator.next()
+}
+
+// fold(key, stripe) folds the operand just read with the older versions of key in stripe
+func (f *versionFilter) fold(key string, stripe int) {
+	versions := []util.Entry{{Key: f.k, Value: f.r}}
+	operands := []string{f.r}
+	var base string
+	hasBase, lastOfKey := false, true
+	for f.advance() {
+		k, seq := parseInternalKey(f.recordIterator.key())
+		if k != key || stripeOf(f.snapshots, seq) != stripe {
+			f.ahead, lastOfKey = true, k != key
+			break
+		}
+		raw := f.recordIterator.raw()
+		versions = append(versions, util.Entry{Key: f.recordIterator.key(), Value: raw})
+		if raw[0] != MERGE_MARKER {
+			base, hasBase = raw, true
+			break
+		}
+		operands = append(operands, raw)
+	}
+
+	var err error
+	switch {
+	case hasBase && !foldsInto(base):
+		f.r, err = partialMerge(f.op, key, operands)
+		f.queue = versions[len(versions)-1:]
+	case hasBase || (f.dropTombstones && stripe == 0 && lastOfKey):
+		f.r, err = fullMerge(f.op, key, operands, base, hasBase)
+	default:
+		f.r, err = partialMerge(f.op, key, operands)
+	}
+	if err != nil {
+		log.Println("not folding", err)
+		f.r, f.queue = versions[0].Value, versions[1:]
+	}
+}
+
+func (f *versionFilter) key() string {
+	return f.k
+}
+
+func (f *versionFilter) raw() string {
+	return f.r
+}
+
+// pushBack() makes next() return the current record again
+func (f *versionFilter) pushBack() {
+	f.pushedBack = true
+}
@@ -0,0 +1,381 @@
+package engine
+
+import (
+	"fmt"
+	"maps"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func assertLevelsNonOverlapping(t *testing.T, nob *Nob) {
+	t.Helper()
+	for level := 1; level < NUM_LEVELS; level++ {
+		files := nob.currentVersion().levels[level]
+		for i := 1; i < len(files); i++ {
+			if files[i-1].largest >= files[i].smallest {
+				t.Fatalf("L%v files %v and %v overlap", level, files[i-1].name, files[i].name)
+			}
+		}
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	strategy := NewLeveledStrategy()
+	strategy.LevelBaseSize = 300
+	strategy.MaxFileSize = 200
+	nob := getNobWithStrategy(t, t.TempDir(), strategy)
+
+	want := map[string]string{}
+	r := rand.New(rand.NewSource(42))
+	for i := range 2000 {
+		key := fmt.Sprintf("key%04d", r.Intn(500))
+		val := fmt.Sprintf("val%v", i)
+		_ = nob.Set(key, val)
+		want[key] = val
+	}
+	nob.waitForFlushes()
+	nob.runPendingCompactions()
+
+	if len(nob.currentVersion().levels[0]) >= strategy.L0Trigger {
+		t.Fatalf("L0 has %v files, should've been compacted", len(nob.currentVersion().levels[0]))
+	}
+	if len(nob.currentVersion().levels[2]) == 0 {
+		t.Fatal("L1 should've spilled into L2")
+	}
+	assertLevelsNonOverlapping(t, nob)
+
+	for k, v := range want {
+		got, err := nob.Get(k)
+		if err != nil || got != v {
+			t.Fatalf("key %v got %v want %v", k, got, v)
+		}
+		if n := len(nob.currentVersion().candidates(k)); n > len(nob.currentVersion().levels[0])+NUM_LEVELS-1 {
+			t.Fatalf("get would consult %v files", n)
+		}
+	}
+}
+
+func TestTombstoneSurvivesAboveOlderLevel(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	flush := func() {
+		nob.writeMu.Lock()
+		nob.freezeMemtable()
+		nob.writeMu.Unlock()
+		nob.waitForFlushes()
+	}
+	_ = nob.Set("x", "marksTheSpot")
+	flush()
+	nob.mergeCompact()
+	// push x below L1
+	nob.compactMu.Lock()
+	nob.runCompaction(&compaction{inputs: nob.currentVersion().levels[1], outputLevel: 2})
+	nob.compactMu.Unlock()
+
+	_ = nob.Delete("x")
+	flush()
+	nob.mergeCompact()
+
+	if len(nob.currentVersion().levels[2]) == 0 {
+		t.Fatal("x should still be in L2")
+	}
+	_, err := nob.Get("x")
+	if err != ErrKeyNotFound {
+		t.Fatalf("got %v want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestManifestSurvivesRestart(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	for i := range 200 {
+		_ = nob.Set(fmt.Sprintf("key%03d", i), "val")
+	}
+	nob.waitForFlushes()
+	nob.runPendingCompactions()
+	want := nob.currentVersion().all()
+
+	_ = nob.Close()
+	restarted := getNob(t, tdir)
+	got := restarted.version.all()
+	if len(got) != len(want) {
+		t.Fatalf("got %v files want %v", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].bloom == nil {
+			t.Fatalf("bloom filter of %v wasn't loaded", got[i].name)
+		}
+		if g, w := formatFileMeta(got[i]), formatFileMeta(want[i]); g != w {
+			t.Fatalf("got %v want %v", g, w)
+		}
+	}
+}
+
+func TestRecoverQuarantinesFilesMissingFromManifest(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("key%03d", i), "val")
+	}
+	// a compaction output that never made it into the manifest
+	_ = os.WriteFile(path.Join(tdir, "compacted_99"), []byte("zzz val\n"), 0644)
+	_ = os.WriteFile(path.Join(tdir, "indx_compacted_99"), []byte("zzz 0\n"), 0644)
+
+	_ = nob.Close()
+	restarted := getNob(t, tdir)
+
+	if _, err := restarted.Get("zzz"); err != ErrKeyNotFound {
+		t.Fatalf("got %v want %v", err, ErrKeyNotFound)
+	}
+	if _, err := os.Stat(path.Join(tdir, QUARANTINE_DIR, "compacted_99")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSizeTieredPicksSimilarRun(t *testing.T) {
+	v := &version{}
+	// newest first: a fresh run of small flushes, then an older big tier
+	for i, size := range []int64{100, 110, 90, 105, 1000, 950} {
+		v.levels[0] = append(v.levels[0], &fileMeta{name: fmt.Sprintf("seg_%v", 10-i), size: size})
+	}
+
+	nob := &Nob{}
+	c := NewSizeTieredStrategy().Pick(nob.levelsOf(v))
+	if c == nil || len(c.Inputs) != 4 || c.Inputs[0].Name != "seg_10" || c.Inputs[3].Name != "seg_7" {
+		t.Fatalf("got %v want the 4 small files", c)
+	}
+	if c.OutputLevel != 0 {
+		t.Fatalf("got level %v want 0", c.OutputLevel)
+	}
+
+	v.levels[0] = v.levels[0][3:]
+	if c := NewSizeTieredStrategy().Pick(nob.levelsOf(v)); c != nil {
+		t.Fatalf("got %v want nothing to compact", c.Inputs)
+	}
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	nob := getNobWithStrategy(t, t.TempDir(), NewSizeTieredStrategy())
+
+	want := map[string]string{}
+	r := rand.New(rand.NewSource(7))
+	for i := range 1000 {
+		key := fmt.Sprintf("key%04d", r.Intn(300))
+		val := fmt.Sprintf("val%v", i)
+		if i%10 == 0 {
+			_ = nob.Delete(key)
+			delete(want, key)
+			continue
+		}
+		_ = nob.Set(key, val)
+		want[key] = val
+	}
+	nob.waitForFlushes()
+	nob.runPendingCompactions()
+
+	for level := 1; level < NUM_LEVELS; level++ {
+		if len(nob.currentVersion().levels[level]) != 0 {
+			t.Fatal("size-tiered should only use L0")
+		}
+	}
+	if len(nob.currentVersion().levels[0]) >= 20 {
+		t.Fatalf("%v L0 files, tiers weren't merged", len(nob.currentVersion().levels[0]))
+	}
+
+	got := collect(nob.Scan("", ""))
+	if !maps.Equal(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestKeysReadableAcrossCompactionCycles(t *testing.T) {
+	for name, strategy := range map[string]func() CompactionStrategy{
+		"leveled":     func() CompactionStrategy { return testLeveledStrategy() },
+		"size-tiered": func() CompactionStrategy { return NewSizeTieredStrategy() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			tdir := t.TempDir()
+			nob := getNobWithStrategy(t, tdir, strategy())
+			_ = nob.Set("anchor", "first")
+			want := map[string]string{"anchor": "first"}
+
+			check := func(cycle int) {
+				t.Helper()
+				for k, v := range want {
+					if got, err := nob.Get(k); err != nil || got != v {
+						t.Fatalf("cycle %v: key %v got %v %v want %v", cycle, k, got, err, v)
+					}
+				}
+			}
+			for cycle := range 5 {
+				for i := range 60 {
+					key := fmt.Sprintf("key%02d", (cycle*7+i)%80)
+					val := fmt.Sprintf("c%v-%v", cycle, i)
+					_ = nob.Set(key, val)
+					want[key] = val
+				}
+				nob.mergeCompact()
+				check(cycle)
+
+				var compacted int
+				for _, f := range nob.currentVersion().all() {
+					if strings.HasPrefix(f.name, "compacted_") {
+						compacted++
+					}
+				}
+				if compacted == 0 {
+					t.Fatalf("cycle %v: nothing compacted", cycle)
+				}
+			}
+
+			_ = nob.Close()
+			nob = getNobWithStrategy(t, tdir, strategy())
+			check(5)
+		})
+	}
+}
+
+func benchmarkStrategy(b *testing.B, strategy CompactionStrategy) {
+	nob := getNobWithStrategy(b, b.TempDir(), strategy)
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = nob.Set(fmt.Sprintf("key%06d", r.Intn(10000)), "value")
+	}
+	nob.waitForFlushes()
+	nob.runPendingCompactions()
+}
+
+func BenchmarkLeveledWrites(b *testing.B) {
+	benchmarkStrategy(b, testLeveledStrategy())
+}
+
+func BenchmarkSizeTieredWrites(b *testing.B) {
+	benchmarkStrategy(b, NewSizeTieredStrategy())
+}
+
+// bottomStrategy pushes all of L0 straight to the last level, as a strategy outside
+// the package could
+type bottomStrategy struct{ picks int }
+
+func (s *bottomStrategy) Pick(levels *Levels) *Compaction {
+	if len(levels.Files[0]) < 2 {
+		return nil
+	}
+	return s.Full(levels)
+}
+
+func (s *bottomStrategy) Full(levels *Levels) *Compaction {
+	s.picks++
+	if len(levels.Files[0]) == 0 {
+		return nil
+	}
+	inputs := append(append([]FileInfo{}, levels.Files[0]...), levels.Files[NUM_LEVELS-1]...)
+	return &Compaction{Inputs: inputs, OutputLevel: NUM_LEVELS - 1}
+}
+
+func TestCustomStrategy(t *testing.T) {
+	strategy := &bottomStrategy{}
+	nob := getNobWithStrategy(t, t.TempDir(), strategy)
+	want := map[string]string{}
+	for i := range 200 {
+		key := fmt.Sprintf("key%03d", i%70)
+		want[key] = fmt.Sprintf("val%v", i)
+		_ = nob.Set(key, want[key])
+	}
+	nob.mergeCompact()
+
+	v := nob.currentVersion()
+	if len(v.levels[0]) != 0 || len(v.levels[NUM_LEVELS-1]) == 0 {
+		t.Fatalf("got %v want everything in the last level", levelNames(v))
+	}
+	if got := collect(nob.Scan("", "")); !maps.Equal(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestBadCompactionIsIgnored(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("x", "y")
+	nob.writeMu.Lock()
+	nob.freezeMemtable()
+	nob.writeMu.Unlock()
+	nob.mergeCompact()
+	v := nob.currentVersion()
+	l1 := FileInfo{Name: v.levels[1][0].name}
+
+	for _, c := range []*Compaction{
+		{Inputs: []FileInfo{{Name: "compacted_999"}}, OutputLevel: 1},
+		{Inputs: []FileInfo{l1, l1}, OutputLevel: 2},
+		{Inputs: []FileInfo{l1}, OutputLevel: 0},
+		{Inputs: []FileInfo{l1}, OutputLevel: NUM_LEVELS},
+		{OutputLevel: 2},
+	} {
+		if _, err := resolve(v, c); err == nil {
+			t.Fatalf("%+v should've been rejected", c)
+		}
+	}
+	if _, err := resolve(v, &Compaction{Inputs: []FileInfo{l1}, OutputLevel: 2}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedStrategyKeepsNoState(t *testing.T) {
+	strategy := NewLeveledStrategy()
+	strategy.LevelBaseSize = 300
+	strategy.MaxFileSize = 200
+	a := getNobWithStrategy(t, t.TempDir(), strategy)
+	b := getNobWithStrategy(t, t.TempDir(), strategy)
+	for i := range 1000 {
+		_ = a.Set(fmt.Sprintf("key%04d", i%400), "val")
+	}
+	a.mergeCompact()
+
+	if a.compactPointer == ([NUM_LEVELS]string{}) {
+		t.Fatal("compactions out of L1 should've moved a's pointer")
+	}
+	if b.compactPointer != ([NUM_LEVELS]string{}) {
+		t.Fatalf("b picked up a's pointer %v", b.compactPointer)
+	}
+}
+
+func TestUnsortedLegacySegmentSurvivesCompaction(t *testing.T) {
+	tdir := t.TempDir()
+	// compactions before sstables wrote their output & a full index in map order
+	want := map[string]string{"pear": "3", "apple": "1", "zucchini": "5", "fig": "2", "mango": "4"}
+	var seg, indx strings.Builder
+	for _, k := range []string{"pear", "apple", "zucchini", "fig", "mango"} {
+		fmt.Fprintf(&indx, "%v %v\n", k, seg.Len())
+		fmt.Fprintf(&seg, "%v %v\n", k, want[k])
+	}
+	_ = os.WriteFile(path.Join(tdir, "compacted_3"), []byte(seg.String()), 0644)
+	_ = os.WriteFile(path.Join(tdir, "indx_compacted_3"), []byte(indx.String()), 0644)
+
+	nob := getNob(t, tdir)
+	f := nob.currentVersion().levels[0][0]
+	if f.smallest != "apple" || f.largest != "zucchini" {
+		t.Fatalf("got range [%v, %v] want [apple, zucchini]", f.smallest, f.largest)
+	}
+	check := func() {
+		t.Helper()
+		for k, v := range want {
+			if got, err := nob.Get(k); err != nil || got != v {
+				t.Fatalf("key %v got %v %v want %v", k, got, err, v)
+			}
+		}
+		if got := collect(nob.Scan("b", "n")); !maps.Equal(got, map[string]string{"fig": "2", "mango": "4"}) {
+			t.Fatalf("got %v", got)
+		}
+	}
+	check()
+
+	nob.mergeCompact()
+	for _, f := range nob.currentVersion().all() {
+		if !isSSTable(path.Join(tdir, f.name)) {
+			t.Fatalf("%v wasn't rewritten", f.name)
+		}
+	}
+	check()
+}
@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"log"
+)
+
+// Codec is how the records of a data block are compressed
+type Codec byte
+
+const NO_COMPRESSION Codec = 0
+const FLATE_COMPRESSION Codec = 1
+
+const DEFAULT_COMPRESSION = FLATE_COMPRESSION
+
+// blockEncoder reuses its flate writer across the blocks of a table
+type blockEncoder struct {
+	buf bytes.Buffer
+	fw  *flate.Writer
+}
+
+// encode(codec, block) returns | codec | block compressed with codec |.
+// Blocks that don't shrink are stored uncompressed, saving the decompression on reads.
+func (e *blockEncoder) encode(codec Codec, block []byte) []byte {
+	if codec == FLATE_COMPRESSION {
+		e.buf.Reset()
+		e.buf.WriteByte(byte(FLATE_COMPRESSION))
+		if e.fw == nil {
+			fw, err := flate.NewWriter(&e.buf, flate.DefaultCompression)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			e.fw = fw
+		} else {
+			e.fw.Reset(&e.buf)
+		}
+		_, err := e.fw.Write(block)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = e.fw.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if e.buf.Len() < len(block)+1 {
+			return append([]byte{}, e.buf.Bytes()...)
+		}
+	}
+	return append([]byte{byte(NO_COMPRESSION)}, block...)
+}
+
+// decodeBlock(payload) undoes encode
+func decodeBlock(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, errCorruptBlock
+	}
+	switch Codec(payload[0]) {
+	case NO_COMPRESSION:
+		return payload[1:], nil
+	case FLATE_COMPRESSION:
+		fr := flate.NewReader(bytes.NewReader(payload[1:]))
+		defer fr.Close()
+		block, err := io.ReadAll(fr)
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		return block, nil
+	default:
+		return nil, errCorruptBlock
+	}
+}
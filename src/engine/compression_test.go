@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"fmt"
+	"path"
+	"testing"
+)
+
+func writePrefixedKeys(nob *Nob, from, to int) {
+	for i := from; i < to; i++ {
+		_ = nob.Set(fmt.Sprintf("tenant/acme/users/profile/%06d", i), `{"plan": "enterprise", "active": true}`)
+	}
+}
+
+func TestCompressionShrinksSegments(t *testing.T) {
+	sizes := map[Codec]int64{}
+	for _, codec := range []Codec{NO_COMPRESSION, FLATE_COMPRESSION} {
+		opts := testOptions(NewSizeTieredStrategy())
+		opts.BlockSize = 4096
+		opts.Compression = codec
+		nob := getNobWithOptions(t, t.TempDir(), opts)
+		writePrefixedKeys(nob, 0, 300)
+		nob.mergeCompact()
+		sizes[codec] = nob.currentVersion().levelSize(0)
+
+		got, err := nob.Get("tenant/acme/users/profile/000123")
+		if err != nil || got != `{"plan": "enterprise", "active": true}` {
+			t.Fatalf("codec %v got %v %v", codec, got, err)
+		}
+	}
+	if sizes[FLATE_COMPRESSION] >= sizes[NO_COMPRESSION]/2 {
+		t.Fatalf("flate %v bytes, uncompressed %v bytes", sizes[FLATE_COMPRESSION], sizes[NO_COMPRESSION])
+	}
+}
+
+func TestMixedCodecsStayReadable(t *testing.T) {
+	tdir := t.TempDir()
+	// no tier is ever merged, which would rewrite every block with flate
+	strategy := NewSizeTieredStrategy()
+	strategy.MinThreshold = 100
+	opts := testOptions(strategy)
+	opts.BlockSize = 512
+	opts.Compression = NO_COMPRESSION
+	nob := getNobWithOptions(t, tdir, opts)
+	writePrefixedKeys(nob, 0, 10)
+	nob.waitForFlushes()
+	_ = nob.Close()
+
+	// reopened with flate, the segments already written keep their codec
+	opts.Compression = FLATE_COMPRESSION
+	nob = getNobWithOptions(t, tdir, opts)
+	writePrefixedKeys(nob, 10, 20)
+
+	nob.waitForFlushes()
+	codecs := map[Codec]bool{}
+	for _, f := range nob.currentVersion().all() {
+		table, err := openSSTable(path.Join(tdir, f.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range table.index {
+			payload, err := table.readChecksummed(h.offset, h.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			codecs[Codec(payload[0])] = true
+		}
+		table.close()
+	}
+	if !codecs[NO_COMPRESSION] || !codecs[FLATE_COMPRESSION] {
+		t.Fatalf("wanted blocks of both codecs, got %v", codecs)
+	}
+
+	it := nob.Scan("", "")
+	defer it.Close()
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != 20 {
+		t.Fatalf("scanned %v keys want 20", n)
+	}
+}
@@ -0,0 +1,293 @@
+package engine
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+// run with -race
+func TestConcurrentSetGetCompact(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	const writers, writes = 4, 150
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range writes {
+				if err := nob.Set(fmt.Sprintf("w%v-key%02d", w, i%20), strconv.Itoa(i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	var readers sync.WaitGroup
+	for r := range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("w%v-key%02d", (r+i)%writers, i%20)
+				val, err := nob.Get(key)
+				if err != nil && err != ErrKeyNotFound {
+					t.Error(key, err)
+					return
+				}
+				if err == nil {
+					if _, convErr := strconv.Atoi(val); convErr != nil {
+						t.Errorf("key %v got torn value %q", key, val)
+						return
+					}
+				}
+
+				it := nob.Prefix(fmt.Sprintf("w%v-", r%writers))
+				for it.Next() {
+					if !strings.HasPrefix(it.Key(), fmt.Sprintf("w%v-", r%writers)) {
+						t.Errorf("scan returned %v", it.Key())
+					}
+				}
+				it.Close()
+			}
+		}()
+	}
+
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				nob.mergeCompact()
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	for w := range writers {
+		for k := range 20 {
+			key := fmt.Sprintf("w%v-key%02d", w, k)
+			// the last write to key k
+			want := strconv.Itoa((writes-1-k)/20*20 + k)
+			if got, err := nob.Get(key); err != nil || got != want {
+				t.Fatalf("key %v got %v %v want %v", key, got, err, want)
+			}
+		}
+	}
+}
+
+func TestReadsAndWritesDontWaitForCompaction(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("before", "val")
+
+	// a compaction that never finishes
+	nob.compactMu.Lock()
+	defer nob.compactMu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for i := range 50 {
+			_ = nob.Set(fmt.Sprintf("key%02d", i), "val")
+		}
+		if _, err := nob.Get("before"); err != nil {
+			t.Error(err)
+		}
+		it := nob.Scan("", "")
+		for it.Next() {
+		}
+		it.Close()
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("blocked behind a compaction")
+	}
+}
+
+func TestScanKeepsCompactedFilesUntilClosed(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	// the scheduler would compact the segments before the scan pins them
+	nob.compactMu.Lock()
+	for i := range 40 {
+		_ = nob.Set(fmt.Sprintf("key%02d", i), "val")
+	}
+	nob.waitForFlushes()
+	it := nob.Scan("", "")
+	nob.compactMu.Unlock()
+	pinned := it.version.levels[0]
+	if len(pinned) == 0 {
+		t.Fatal("wanted L0 files")
+	}
+
+	nob.mergeCompact()
+	for _, f := range pinned {
+		if _, err := os.Stat(path.Join(tdir, f.name)); err != nil {
+			t.Fatalf("%v deleted while scanned: %v", f.name, err)
+		}
+	}
+
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != 40 {
+		t.Fatalf("scanned %v keys want 40", n)
+	}
+
+	it.Close()
+	for _, f := range pinned {
+		if _, err := os.Stat(path.Join(tdir, f.name)); !os.IsNotExist(err) {
+			t.Fatalf("%v outlived its last reader: %v", f.name, err)
+		}
+	}
+}
+
+func TestConcurrentWritesShareAWalRecord(t *testing.T) {
+	tdir := t.TempDir()
+	opts := testOptions(testLeveledStrategy())
+	opts.MemtableSize = 1 << 20
+	nob := getNobWithOptions(t, tdir, opts)
+
+	// writers queue up behind a writer holding writeMu
+	const writers = 20
+	nob.writeMu.Lock()
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := nob.Set(fmt.Sprintf("key%02d", i), "val"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for queued := 0; queued < writers; time.Sleep(time.Millisecond) {
+		nob.pendingMu.Lock()
+		queued = len(nob.pending)
+		nob.pendingMu.Unlock()
+	}
+	nob.writeMu.Unlock()
+	wg.Wait()
+
+	f, err := os.Open(path.Join(tdir, WAL_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records int
+	_ = replayRecords(f, int64(len(WAL_MAGIC)), func([]byte) error {
+		records++
+		return nil
+	})
+	if records != 1 {
+		t.Fatalf("%v writes took %v wal records want 1", writers, records)
+	}
+	for i := range writers {
+		if got, err := nob.Get(fmt.Sprintf("key%02d", i)); err != nil || got != "val" {
+			t.Fatalf("key%02d got %v %v", i, got, err)
+		}
+	}
+}
+
+func TestSkipListOverwritesFlushInsteadOfGrowing(t *testing.T) {
+	opts := testOptions(testLeveledStrategy())
+	opts.NewMemtable = func() util.OrderedMap { return util.NewSkipList() }
+	nob := getNobWithOptions(t, t.TempDir(), opts)
+
+	for i := range 500 {
+		_ = nob.Set("hot", strconv.Itoa(i))
+		nob.mu.RLock()
+		size := nob.memtable.GetSize()
+		nob.mu.RUnlock()
+		if int64(size) > opts.MemtableSize {
+			t.Fatalf("memtable grew to %v bytes past its %v", size, opts.MemtableSize)
+		}
+	}
+	if got, err := nob.Get("hot"); err != nil || got != "499" {
+		t.Fatalf("got %v %v", got, err)
+	}
+
+	// the versions flushed are dropped by compaction
+	nob.mergeCompact()
+	var records int
+	for _, f := range nob.currentVersion().all() {
+		it := nob.newSegmentIterator(path.Join(nob.rootDir, f.name), "")
+		for it.next() {
+			records++
+		}
+		it.close()
+	}
+	if records != 1 {
+		t.Fatalf("%v versions of hot outlived compaction", records)
+	}
+}
+
+// BenchmarkParallelSetGet runs gets from many goroutines while sets keep coming.
+// Gets don't wait for each other, nor for sets into a util.SkipList memtable.
+func BenchmarkParallelSetGet(b *testing.B) {
+	memtables := map[string]func() util.OrderedMap{
+		"avl":      func() util.OrderedMap { return util.NewAVLMap() },
+		"skiplist": func() util.OrderedMap { return util.NewSkipList() },
+	}
+	for name, newMemtable := range memtables {
+		b.Run(name, func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.NewMemtable = newMemtable
+			nob := getNobWithOptions(b, b.TempDir(), opts)
+			for i := range 1000 {
+				_ = nob.Set(fmt.Sprintf("key%04d", i), "value")
+			}
+
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					default:
+						_ = nob.Set(fmt.Sprintf("key%04d", i%1000), "value")
+					}
+				}
+			}()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Int()
+				for pb.Next() {
+					_, _ = nob.Get(fmt.Sprintf("key%04d", i%1000))
+					i++
+				}
+			})
+			b.StopTimer()
+			close(done)
+			wg.Wait()
+		})
+	}
+}
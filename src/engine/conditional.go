@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"errors"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+// ErrConditionFailed is returned by conditional writes whose condition didn't hold,
+// nothing was written
+var ErrConditionFailed = errors.New("condition failed")
+
+// ANY_VERSION makes SetIfVersion match any live version of a key
+const ANY_VERSION = MAX_SEQUENCE
+
+// The version of a value is the sequence number of the write that set it. It changes
+// with every write of the key, even one writing the same value again.
+
+// GetVersion(key) returns the value of key and its version
+func (nob *Nob) GetVersion(key string) (string, uint64, error) {
+	raw, seq, found, err := nob.lookup(key, MAX_SEQUENCE)
+	if err != nil {
+		return "", 0, err
+	}
+	if !found {
+		return "", 0, ErrKeyNotFound
+	}
+	val, live := unmarkValue(raw)
+	if !live {
+		return "", 0, ErrKeyNotFound
+	}
+	return val, seq, nil
+}
+
+// CompareAndSet(key, expected, val) sets key to val if its value is expected,
+// returning the version written
+func (nob *Nob) CompareAndSet(key, expected, val string) (uint64, error) {
+	return nob.setIf(key, val, func(raw string, _ uint64) bool {
+		cur, live := unmarkValue(raw)
+		return live && cur == expected
+	})
+}
+
+// SetIfAbsent(key, val) sets key to val if it has no value, returning the version written
+func (nob *Nob) SetIfAbsent(key, val string) (uint64, error) {
+	return nob.setIf(key, val, func(raw string, _ uint64) bool {
+		_, live := unmarkValue(raw)
+		return !live
+	})
+}
+
+// SetIfVersion(key, val, version) sets key to val if its value still is the one of
+// version, or any value for ANY_VERSION. It returns the version written.
+func (nob *Nob) SetIfVersion(key, val string, version uint64) (uint64, error) {
+	return nob.setIf(key, val, func(raw string, seq uint64) bool {
+		_, live := unmarkValue(raw)
+		return live && (version == ANY_VERSION || seq == version)
+	})
+}
+
+// setIf(key, val, cond) sets key to val if cond holds for the marked value & version of key,
+// a tombstone for keys never written.
+//
+// key is read before writers are held off. If it was written meanwhile, may have been
+// flushed since, or may have expired, it's read again with them held off.
+func (nob *Nob) setIf(key, val string, cond func(raw string, seq uint64) bool) (uint64, error) {
+	at := nob.lastSeq.Load()
+	raw, seq, err := nob.versionOf(key, at)
+	if err != nil {
+		return 0, err
+	}
+	if !cond(raw, seq) {
+		return 0, ErrConditionFailed
+	}
+
+	nob.writeMu.Lock()
+	defer nob.writeMu.Unlock()
+	if written, ok := nob.writtenSince([]string{key}, at); written || !ok || raw[0] == EXPIRING_MARKER {
+		raw, seq, err = nob.versionOf(key, MAX_SEQUENCE)
+		if err != nil {
+			return 0, err
+		}
+		if !cond(raw, seq) {
+			return 0, ErrConditionFailed
+		}
+	}
+
+	err = nob.write(&WriteBatch{entries: []util.Entry{{Key: key, Value: string(VALUE_MARKER) + val}}})
+	if err != nil {
+		return 0, err
+	}
+	// lastSeq only changes with writeMu held
+	return nob.lastSeq.Load(), nil
+}
+
+// versionOf(key, at) returns the marked value & version of key as of at, a tombstone
+// for keys never written
+func (nob *Nob) versionOf(key string, at uint64) (string, uint64, error) {
+	raw, seq, found, err := nob.lookup(key, at)
+	if err != nil {
+		return "", 0, err
+	}
+	if !found {
+		return string(TOMBSTONE_MARKER), 0, nil
+	}
+	return raw, seq, nil
+}
@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+func TestCompareAndSet(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	if _, err := nob.CompareAndSet("k", "", "v"); err != ErrConditionFailed {
+		t.Fatalf("CAS of a missing key got %v", err)
+	}
+	_ = nob.Set("k", "old")
+	if _, err := nob.CompareAndSet("k", "other", "new"); err != ErrConditionFailed {
+		t.Fatalf("got %v", err)
+	}
+	if got, _ := nob.Get("k"); got != "old" {
+		t.Fatalf("failed CAS wrote %v", got)
+	}
+	version, err := nob.CompareAndSet("k", "old", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, v, _ := nob.GetVersion("k"); got != "new" || v != version {
+		t.Fatalf("got %v version %v want new version %v", got, v, version)
+	}
+}
+
+func TestSetIfAbsent(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	if _, err := nob.SetIfAbsent("k", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nob.SetIfAbsent("k", "second"); err != ErrConditionFailed {
+		t.Fatalf("got %v", err)
+	}
+	_ = nob.Delete("k")
+	if _, err := nob.SetIfAbsent("k", "third"); err != nil {
+		t.Fatalf("deleted key isn't absent: %v", err)
+	}
+	if got, _ := nob.Get("k"); got != "third" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestSetIfVersion(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	if _, err := nob.SetIfVersion("k", "v", ANY_VERSION); err != ErrConditionFailed {
+		t.Fatalf("missing key matched any version: %v", err)
+	}
+	_ = nob.Set("k", "v1")
+	_, version, _ := nob.GetVersion("k")
+
+	// rewriting the same value is a new version
+	_ = nob.Set("k", "v1")
+	if _, err := nob.SetIfVersion("k", "v2", version); err != ErrConditionFailed {
+		t.Fatalf("stale version got %v", err)
+	}
+
+	// versions survive flushes & compaction
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("junk%02d", i), "values")
+	}
+	_, version, _ = nob.GetVersion("k")
+	nob.mergeCompact()
+	if _, v, _ := nob.GetVersion("k"); v != version {
+		t.Fatalf("version changed from %v to %v by compaction", version, v)
+	}
+	if _, err := nob.SetIfVersion("k", "v2", version); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nob.SetIfVersion("k", "v3", ANY_VERSION); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := nob.Get("k"); got != "v3" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestConditionalWritesAreAtomic(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("counter", "0")
+
+	var wg sync.WaitGroup
+	var holders atomic.Int32
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := nob.SetIfAbsent("lock", fmt.Sprint(w)); err == nil {
+				holders.Add(1)
+			}
+			for i := range 25 {
+				_ = nob.Set(fmt.Sprintf("noise%v-%v", w, i), "values")
+				for {
+					val, _ := nob.Get("counter")
+					n, _ := strconv.Atoi(val)
+					if _, err := nob.CompareAndSet("counter", val, strconv.Itoa(n+1)); err == nil {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := holders.Load(); n != 1 {
+		t.Fatalf("%v writers took the lock", n)
+	}
+	if got, _ := nob.Get("counter"); got != "200" {
+		t.Fatalf("got %v after 200 increments", got)
+	}
+}
+
+func TestConditionRecheckedUnderTheWriteLock(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+
+	// a writer holds writeMu while SetIfAbsent waits for it, having found lock absent
+	nob.writeMu.Lock()
+	res := make(chan error)
+	go func() {
+		_, err := nob.SetIfAbsent("lock", "mine")
+		res <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_ = nob.write(&WriteBatch{entries: []util.Entry{{Key: "lock", Value: string(VALUE_MARKER) + "theirs"}}})
+	nob.writeMu.Unlock()
+
+	if err := <-res; err != ErrConditionFailed {
+		t.Fatalf("got %v want %v", err, ErrConditionFailed)
+	}
+	if got, _ := nob.Get("lock"); got != "theirs" {
+		t.Fatalf("got %v want theirs", got)
+	}
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+const DEFAULT_FLUSH_QUEUE_DEPTH = 2
+
+var frozenWalRxp = regexp.MustCompile(`^wal_(seg_\d+)$`)
+
+// immutableMemtable is a full memtable waiting to be flushed to segName.
+// Its writes stay in the wal named walNameOf(segName) until the segment is live.
+type immutableMemtable struct {
+	memtable util.OrderedMap
+	segName  string
+	// lastSeq numbers the latest write memtable holds
+	lastSeq uint64
+}
+
+// startFlusher() flushes immutable memtables oldest first in the background,
+// so a write filling the memtable doesn't pay for writing the segment.
+// On close it drains the queue before exiting.
+func (nob *Nob) startFlusher() {
+	nob.flusherDone = make(chan struct{})
+	go func() {
+		defer close(nob.flusherDone)
+		for {
+			nob.mu.Lock()
+			for len(nob.immutables) == 0 && !nob.closing {
+				nob.queueChanged.Wait()
+			}
+			if len(nob.immutables) == 0 {
+				nob.mu.Unlock()
+				return
+			}
+			imm := nob.immutables[len(nob.immutables)-1]
+			nob.mu.Unlock()
+
+			nob.flushImmutable(imm)
+		}
+	}()
+}
+
+// freezeMemtable() queues the memtable for flushing and starts a new one.
+// It stalls while the queue is full, so writes can't outrun the flusher.
+//
+// Call with writeMu held.
+func (nob *Nob) freezeMemtable() {
+	nob.mu.Lock()
+	for len(nob.immutables) >= nob.opts.FlushQueueDepth {
+		nob.queueChanged.Wait()
+	}
+	nob.mu.Unlock()
+
+	segName := fmt.Sprintf("seg_%v", nob.allocateSeg())
+	w, err := nob.wal.rotate(nob.rootDir, segName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	nob.wal = w
+
+	nob.mu.Lock()
+	imm := &immutableMemtable{memtable: nob.memtable, segName: segName, lastSeq: nob.lastSeq.Load()}
+	nob.immutables = append([]*immutableMemtable{imm}, nob.immutables...)
+	nob.memtable = nob.opts.NewMemtable()
+	nob.queueChanged.Broadcast()
+	nob.mu.Unlock()
+}
+
+// flushImmutable(imm) writes imm into L0 with seg_{segNo} format.
+// imm is dequeued only once its wal is gone, until then readers find its keys
+// in both imm and the segment.
+//
+// The edit records imm's last sequence number, the wal holding it is about to go.
+func (nob *Nob) flushImmutable(imm *immutableMemtable) {
+	records := nob.newVersionFilter(newMemtableIterator(imm.memtable, ""), false)
+	meta := nob.writeSegment(imm.segName, 0, records, 0)
+	if meta != nil {
+		nob.logAndApply(&versionEdit{added: []*fileMeta{meta}, lastSeq: imm.lastSeq})
+	}
+
+	// memtable is on disk, its wal can go
+	err := os.Remove(path.Join(nob.rootDir, walNameOf(imm.segName)))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	nob.mu.Lock()
+	nob.immutables = nob.immutables[:len(nob.immutables)-1]
+	nob.queueChanged.Broadcast()
+	nob.mu.Unlock()
+
+	nob.scheduleCompaction()
+}
+
+// waitForFlushes() blocks until every frozen memtable is on disk
+func (nob *Nob) waitForFlushes() {
+	nob.mu.Lock()
+	defer nob.mu.Unlock()
+	for len(nob.immutables) > 0 {
+		nob.queueChanged.Wait()
+	}
+}
+
+// recoverFrozenMemtables() queues memtables frozen before a restart for flushing again.
+// A crash between publishing a segment and removing its wal leaves a wal that's dropped.
+func (nob *Nob) recoverFrozenMemtables() error {
+	dirFiles, err := os.ReadDir(nob.rootDir)
+	if err != nil {
+		return err
+	}
+	var segNames []string
+	for _, f := range dirFiles {
+		if m := frozenWalRxp.FindStringSubmatch(f.Name()); m != nil {
+			segNames = append(segNames, m[1])
+		}
+	}
+	sort.Slice(segNames, func(i, j int) bool {
+		return segNoOf(segNames[i]) < segNoOf(segNames[j])
+	})
+
+	live := map[string]bool{}
+	for _, f := range nob.version.all() {
+		live[f.name] = true
+	}
+	for _, segName := range segNames {
+		walPath := path.Join(nob.rootDir, walNameOf(segName))
+		if live[segName] {
+			if err := os.Remove(walPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		memtable := nob.opts.NewMemtable()
+		if err := replayWalFile(walPath, nob.replayInto(memtable)); err != nil {
+			return err
+		}
+		imm := &immutableMemtable{memtable: memtable, segName: segName, lastSeq: nob.lastSeq.Load()}
+		nob.immutables = append([]*immutableMemtable{imm}, nob.immutables...)
+	}
+	return nil
+}
+
+// replayInto(memtable) returns a wal replay callback inserting into memtable
+func (nob *Nob) replayInto(memtable util.OrderedMap) func(seq uint64, key, raw string) {
+	return func(seq uint64, key, raw string) {
+		nob.lastSeq.Store(max(nob.lastSeq.Load(), seq))
+		nob.insert(memtable, key, seq, raw)
+	}
+}
@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestGetReadsImmutableMemtables(t *testing.T) {
+	opts := testOptions(testLeveledStrategy())
+	opts.FlushQueueDepth = 4
+	nob := getNobWithOptions(t, t.TempDir(), opts)
+
+	// flushes can write their segment but never publish it
+	nob.manifestMu.Lock()
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("key%02d", i), "val")
+	}
+	nob.mu.Lock()
+	queued := len(nob.immutables)
+	nob.mu.Unlock()
+	if queued == 0 {
+		nob.manifestMu.Unlock()
+		t.Fatal("wanted frozen memtables")
+	}
+	for i := range 20 {
+		if got, err := nob.Get(fmt.Sprintf("key%02d", i)); err != nil || got != "val" {
+			nob.manifestMu.Unlock()
+			t.Fatalf("key%02d got %v %v", i, got, err)
+		}
+	}
+	nob.manifestMu.Unlock()
+
+	nob.waitForFlushes()
+	if len(nob.currentVersion().levels[0]) != queued {
+		t.Fatalf("got %v segments want %v", len(nob.currentVersion().levels[0]), queued)
+	}
+}
+
+func TestWritesStallWhenFlushQueueIsFull(t *testing.T) {
+	opts := testOptions(testLeveledStrategy())
+	opts.FlushQueueDepth = 1
+	nob := getNobWithOptions(t, t.TempDir(), opts)
+
+	nob.manifestMu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 40 {
+			_ = nob.Set(fmt.Sprintf("key%02d", i), "val")
+		}
+	}()
+
+	select {
+	case <-done:
+		nob.manifestMu.Unlock()
+		t.Fatal("writes should stall while the flusher is stuck")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	nob.manifestMu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes never resumed")
+	}
+}
+
+func TestFrozenMemtableSurvivesRestart(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	_ = nob.Set("frozen", "val")
+	_ = nob.Close()
+
+	// crash right after the memtable was frozen
+	err := os.Rename(path.Join(tdir, WAL_NAME), path.Join(tdir, walNameOf("seg_7")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := getNob(t, tdir)
+	if got, err := restarted.Get("frozen"); err != nil || got != "val" {
+		t.Fatalf("got %v %v", got, err)
+	}
+	restarted.waitForFlushes()
+	if _, err := os.Stat(path.Join(tdir, "seg_7")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(tdir, walNameOf("seg_7"))); !os.IsNotExist(err) {
+		t.Fatalf("wal of a flushed memtable should be gone, got %v", err)
+	}
+	// new segments mustn't reuse the frozen memtable's number
+	if n := restarted.allocateSeg(); n <= 7 {
+		t.Fatalf("allocated seg_%v", n)
+	}
+}
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+)
+
+// MAX_SEQUENCE reads the latest version of every key
+const MAX_SEQUENCE = math.MaxUint64
+
+// internal keys are what memtables and sstables are sorted by: a user key and the
+// sequence number of the write, ordered by user key then newest write first.
+//
+//	| escaped user key | 0x00 0x01 | ^seq (8, big endian) |
+//
+// 0x00 bytes in the user key are escaped as 0x00 0xff, so the terminator keeps a key
+// sorting before every longer key it is a prefix of.
+const INTERNAL_KEY_SUFFIX = 10
+
+func makeInternalKey(key string, seq uint64) string {
+	var b strings.Builder
+	b.Grow(len(key) + INTERNAL_KEY_SUFFIX)
+	if strings.IndexByte(key, 0) == -1 {
+		b.WriteString(key)
+	} else {
+		for i := 0; i < len(key); i++ {
+			b.WriteByte(key[i])
+			if key[i] == 0 {
+				b.WriteByte(0xff)
+			}
+		}
+	}
+	b.WriteString("\x00\x01")
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], ^seq)
+	b.Write(s[:])
+	return b.String()
+}
+
+// parseInternalKey(ikey) returns the user key & sequence number of ikey
+func parseInternalKey(ikey string) (string, uint64) {
+	return userKeyOf(ikey), seqOf(ikey)
+}
+
+func userKeyOf(ikey string) string {
+	escaped := ikey[:len(ikey)-INTERNAL_KEY_SUFFIX]
+	if strings.IndexByte(escaped, 0) == -1 {
+		return escaped
+	}
+	return strings.ReplaceAll(escaped, "\x00\xff", "\x00")
+}
+
+func seqOf(ikey string) uint64 {
+	return ^binary.BigEndian.Uint64([]byte(ikey[len(ikey)-8:]))
+}
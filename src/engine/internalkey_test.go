@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestInternalKeysSortByKeyThenNewestFirst(t *testing.T) {
+	ordered := []string{
+		makeInternalKey("", MAX_SEQUENCE),
+		makeInternalKey("", 0),
+		makeInternalKey("\x00", 1),
+		makeInternalKey("\x00\x00", 1),
+		makeInternalKey("\x00a", 1),
+		makeInternalKey("a", 9),
+		makeInternalKey("a", 2),
+		makeInternalKey("a\x00", 5),
+		makeInternalKey("a\x00b", 5),
+		makeInternalKey("ab", 7),
+		makeInternalKey("b", MAX_SEQUENCE),
+	}
+	if !slices.IsSorted(ordered) {
+		t.Fatalf("internal keys out of order")
+	}
+
+	for _, want := range []struct {
+		key string
+		seq uint64
+	}{{"", 0}, {"a\x00b", 5}, {"\x00\x00", MAX_SEQUENCE}, {"hello world", 42}} {
+		key, seq := parseInternalKey(makeInternalKey(want.key, want.seq))
+		if key != want.key || seq != want.seq {
+			t.Fatalf("got %q %v want %q %v", key, seq, want.key, want.seq)
+		}
+	}
+}
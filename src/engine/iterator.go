@@ -0,0 +1,368 @@
+package engine
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+// recordIterator walks the raw (marked) records of a single source in internal key order
+type recordIterator interface {
+	next() bool
+	key() string
+	raw() string
+	// err() returns what stopped next() early, nil at the end of the records
+	err() error
+	close()
+}
+
+// failedIterator is a source that couldn't be opened
+type failedIterator struct {
+	e error
+}
+
+func (f *failedIterator) next() bool  { return false }
+func (f *failedIterator) key() string { return "" }
+func (f *failedIterator) raw() string { return "" }
+func (f *failedIterator) err() error  { return f.e }
+func (f *failedIterator) close()      {}
+
+// Iterator walks live key / values in [start, end) in key order.
+// It must be closed to release the segment files it holds open.
+// Next stops early on a segment that can't be read, see Err, and skips keys whose
+// operands can't be merged, see Failed.
+type Iterator struct {
+	nob     *Nob
+	version *version
+	merged  *mergingIterator
+	// seq is the sequence number read at
+	seq   uint64
+	start string
+	end   string
+	k     string
+	v     string
+	// seen is the last key a version was read of, older ones are skipped
+	seen    string
+	started bool
+	done    bool
+	// ahead is set once merged is on a record Next hasn't looked at yet
+	ahead bool
+	// failed holds why Next skipped keys, their operands failing to merge
+	failed map[string]error
+}
+
+// Scan(start, end) iterates over every live key in [start, end).
+// An empty end means no upper bound.
+//
+// memtables and segments are merged by internal key, so the latest version of
+// a key comes first and deleted keys are skipped. Merge operands are folded into
+// the versions after them.
+//
+// The iterator sees the database as of the call, writes made after it aren't visible.
+func (nob *Nob) Scan(start, end string) *Iterator {
+	return nob.scan(start, end, MAX_SEQUENCE)
+}
+
+// scan(start, end, seq) is Scan reading the versions written at or before seq
+func (nob *Nob) scan(start, end string, seq uint64) *Iterator {
+	nob.mu.RLock()
+	// later writes are skipped even by memtables that see them
+	seq = min(seq, nob.lastSeq.Load())
+	sources := []recordIterator{newMemtableIterator(nob.memtable, start)}
+	for _, imm := range nob.immutables {
+		sources = append(sources, newMemtableIterator(imm.memtable, start))
+	}
+	v := nob.version
+	v.ref()
+	nob.mu.RUnlock()
+
+	for _, f := range v.all() {
+		if f.largest < start || (end != "" && f.smallest >= end) {
+			continue
+		}
+		sources = append(sources, nob.newSegmentIterator(path.Join(nob.rootDir, f.name), start))
+	}
+
+	return &Iterator{
+		nob:     nob,
+		version: v,
+		merged:  newMergingIterator(sources),
+		seq:     seq,
+		start:   start,
+		end:     end,
+	}
+}
+
+// Prefix(p) iterates over every live key starting with p
+func (nob *Nob) Prefix(p string) *Iterator {
+	return nob.Scan(p, prefixEnd(p))
+}
+
+// prefixEnd(p) returns the smallest key greater than every key starting with p,
+// or "" if there is none
+func prefixEnd(p string) string {
+	b := []byte(p)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+func (it *Iterator) Next() bool {
+	for !it.done && it.advance() {
+		key, seq := parseInternalKey(it.merged.key())
+		if seq > it.seq || (it.started && key == it.seen) {
+			continue
+		}
+		it.seen, it.started = key, true
+		if key < it.start {
+			continue
+		}
+		if it.end != "" && key >= it.end {
+			it.done = true
+			break
+		}
+		raw := it.merged.raw()
+		if raw[0] == MERGE_MARKER {
+			var err error
+			raw, err = it.fold(key, raw)
+			if err != nil {
+				if it.failed == nil {
+					it.failed = map[string]error{}
+				}
+				it.failed[key] = err
+				continue
+			}
+		}
+		val, live := unmarkValue(raw)
+		if !live {
+			continue
+		}
+		it.k, it.v = key, val
+		return true
+	}
+	return false
+}
+
+func (it *Iterator) advance() bool {
+	if it.ahead {
+		it.ahead = false
+		return true
+	}
+	return it.merged.next()
+}
+
+// fold(key, operand) folds operand, the version of key read, with the older versions after it
+func (it *Iterator) fold(key, operand string) (string, error) {
+	op := it.nob.opts.MergeOperator
+	operands := []string{operand}
+	for it.merged.next() {
+		if userKeyOf(it.merged.key()) != key {
+			it.ahead = true
+			break
+		}
+		raw := it.merged.raw()
+		if raw[0] != MERGE_MARKER {
+			return fullMerge(op, key, operands, raw, true)
+		}
+		operands = append(operands, raw)
+	}
+	return fullMerge(op, key, operands, "", false)
+}
+
+// Err() returns the error that stopped Next, nil if it reached the end
+func (it *Iterator) Err() error {
+	return it.merged.err()
+}
+
+// Failed() returns the keys Next skipped so far, as their operands failed to merge
+// with ErrMergeFailed
+func (it *Iterator) Failed() map[string]error {
+	return it.failed
+}
+
+func (it *Iterator) Key() string {
+	return it.k
+}
+
+func (it *Iterator) Value() string {
+	return it.v
+}
+
+func (it *Iterator) Close() {
+	it.merged.close()
+	it.nob.releaseVersion(it.version)
+}
+
+// mergingIterator k-way merges sources, which are ordered newest first.
+// When several sources hold the same internal key, as tables written before sequence
+// numbers do, only the newest one is returned.
+type mergingIterator struct {
+	h   *iterHeap
+	k   string
+	r   string
+	e   error
+	all []recordIterator
+}
+
+type heapItem struct {
+	it   recordIterator
+	rank int
+}
+
+type iterHeap []heapItem
+
+func (h iterHeap) Len() int { return len(h) }
+func (h iterHeap) Less(i, j int) bool {
+	if h[i].it.key() == h[j].it.key() {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].it.key() < h[j].it.key()
+}
+func (h iterHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *iterHeap) Push(x any)   { *h = append(*h, x.(heapItem)) }
+func (h *iterHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func newMergingIterator(sources []recordIterator) *mergingIterator {
+	h := &iterHeap{}
+	m := &mergingIterator{h: h, all: sources}
+	for rank, it := range sources {
+		if it.next() {
+			*h = append(*h, heapItem{it: it, rank: rank})
+		} else if m.e == nil {
+			m.e = it.err()
+		}
+	}
+	heap.Init(h)
+	return m
+}
+
+// next() stops at the first source that fails, the rest of the merge would be wrong
+func (m *mergingIterator) next() bool {
+	if m.e != nil || m.h.Len() == 0 {
+		return false
+	}
+	top := heap.Pop(m.h).(heapItem)
+	m.k, m.r = top.it.key(), top.it.raw()
+	m.advance(top)
+
+	// older versions of the same key are shadowed
+	for m.h.Len() > 0 && (*m.h)[0].it.key() == m.k {
+		m.advance(heap.Pop(m.h).(heapItem))
+	}
+	return true
+}
+
+func (m *mergingIterator) advance(item heapItem) {
+	if item.it.next() {
+		heap.Push(m.h, item)
+	} else if m.e == nil {
+		m.e = item.it.err()
+	}
+}
+
+func (m *mergingIterator) key() string {
+	return m.k
+}
+
+func (m *mergingIterator) raw() string {
+	return m.r
+}
+
+func (m *mergingIterator) err() error {
+	return m.e
+}
+
+func (m *mergingIterator) close() {
+	for _, it := range m.all {
+		it.close()
+	}
+}
+
+// memtableIterator walks a memtable without a copy or a lock. Over a util.AVLMap it sees
+// the memtable as it was when created, over a util.SkipList it also sees later inserts.
+type memtableIterator struct {
+	it util.MapIterator
+}
+
+// newMemtableIterator(memtable, start) begins at user key start. It must be called with
+// mu held if memtable is still written to.
+func newMemtableIterator(memtable util.OrderedMap, start string) *memtableIterator {
+	return &memtableIterator{it: memtable.Seek(makeInternalKey(start, MAX_SEQUENCE))}
+}
+
+func (m *memtableIterator) next() bool {
+	return m.it.Next()
+}
+
+func (m *memtableIterator) key() string {
+	return m.it.Key()
+}
+
+func (m *memtableIterator) raw() string {
+	return m.it.Value()
+}
+
+func (m *memtableIterator) err() error {
+	return nil
+}
+
+func (m *memtableIterator) close() {}
+
+// newSegmentIterator(segPath, start) begins reading at the block that would contain start
+func (nob *Nob) newSegmentIterator(segPath string, start string) recordIterator {
+	table, err := openSSTable(segPath)
+	if err == nil {
+		return table.iterator(start)
+	}
+	if err != errNotSSTable {
+		return &failedIterator{e: fmt.Errorf("%v: %w", segPath, err)}
+	}
+	records, err := readTextSegment(segPath)
+	if err != nil {
+		return &failedIterator{e: fmt.Errorf("%v: %w", segPath, err)}
+	}
+	return newMemtableIterator(records, start)
+}
+
+// readTextSegment(segPath) reads a whole segment written before the sstable format, its
+// records as old as sequence number 0. Those written by compactions came out of a map,
+// neither they nor their indexes are sorted, so they're sorted here & the index is ignored.
+func readTextSegment(segPath string) (util.OrderedMap, error) {
+	segFile, err := os.Open(segPath)
+	if err != nil {
+		return nil, err
+	}
+	defer segFile.Close()
+
+	records := util.NewAVLMap()
+	reader := bufio.NewReader(segFile)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" {
+			return records, nil
+		}
+		key, val, live := parseRecord(line)
+		if live {
+			records.Insert(makeInternalKey(key, 0), string(VALUE_MARKER)+val)
+		} else {
+			records.Insert(makeInternalKey(key, 0), string(TOMBSTONE_MARKER))
+		}
+	}
+}
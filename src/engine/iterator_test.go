@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func collect(it *Iterator) map[string]string {
+	defer it.Close()
+	res := map[string]string{}
+	var keys []string
+	for it.Next() {
+		res[it.Key()] = it.Value()
+		keys = append(keys, it.Key())
+	}
+	if !slices.IsSorted(keys) {
+		panic(fmt.Sprint("keys out of order ", keys))
+	}
+	return res
+}
+
+func TestScanNewestWins(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	for i := range 30 {
+		_ = nob.Set(fmt.Sprintf("key%02d", i), "old")
+	}
+	// overwrite & delete some of the flushed keys
+	_ = nob.Set("key03", "new")
+	_ = nob.Set("key20", "new")
+	_ = nob.Delete("key04")
+
+	nob.waitForFlushes()
+	if len(nob.currentVersion().all()) == 0 {
+		t.Fatal("should've flushed a segment")
+	}
+
+	got := collect(nob.Scan("key02", "key06"))
+	want := map[string]string{"key02": "old", "key03": "new", "key05": "old"}
+	if !maps.Equal(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	all := collect(nob.Scan("", ""))
+	if len(all) != 29 || all["key20"] != "new" {
+		t.Fatalf("got %v", all)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("apple", "1")
+	_ = nob.Set("apricot", "2")
+	_ = nob.Set("ap", "3")
+	_ = nob.Set("bat", "4")
+	_ = nob.Set("a", "5")
+
+	got := collect(nob.Prefix("ap"))
+	want := map[string]string{"ap": "3", "apple": "1", "apricot": "2"}
+	if !maps.Equal(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"ap":          "aq",
+		"a\xff":       "b",
+		"\xff\xff":    "",
+		"":            "",
+		"cart-v4\xff": "cart-v5",
+	}
+	for p, want := range cases {
+		if got := prefixEnd(p); got != want {
+			t.Fatalf("prefixEnd(%q) got %q want %q", p, got, want)
+		}
+	}
+}
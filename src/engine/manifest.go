@@ -0,0 +1,219 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const MANIFEST_NAME = "MANIFEST"
+
+// MANIFEST_MAGIC starts every manifest
+const MANIFEST_MAGIC = "NOBMANIFEST1\n"
+
+// MANIFEST_SNAPSHOT_EDITS is how many edits are appended before the manifest is
+// rewritten as a snapshot of the live files, so replaying it stays cheap
+const MANIFEST_SNAPSHOT_EDITS = 1000
+
+// versionEdit is an atomic change to the set of live files.
+// The manifest is a log of them, replayed in order onto an empty version on startup.
+//
+// Encoded as lines of
+//
+//	add level name size "smallest" "largest" smallestSeq largestSeq
+//	del name
+//	seq lastSeq
+//
+// lastSeq (0 if unchanged) numbers the latest write the added files hold, so sequence
+// numbers keep growing across restarts once the wal holding them is gone.
+type versionEdit struct {
+	added   []*fileMeta
+	deleted []string
+	lastSeq uint64
+}
+
+// manifestLog appends version edits to the manifest
+type manifestLog struct {
+	file *os.File
+	// edits appended since the last snapshot
+	edits         int
+	snapshotEvery int
+}
+
+func (e *versionEdit) encode() []byte {
+	var b bytes.Buffer
+	for _, meta := range e.added {
+		b.WriteString("add " + formatFileMeta(meta) + "\n")
+	}
+	for _, name := range e.deleted {
+		b.WriteString("del " + name + "\n")
+	}
+	if e.lastSeq != 0 {
+		b.WriteString("seq " + strconv.FormatUint(e.lastSeq, 10) + "\n")
+	}
+	return b.Bytes()
+}
+
+func decodeEdit(payload []byte) (*versionEdit, error) {
+	e := &versionEdit{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(payload), "\n"), "\n") {
+		op, arg, _ := strings.Cut(line, " ")
+		switch op {
+		case "":
+			// the snapshot of an empty version
+		case "add":
+			meta, err := parseFileMeta(arg)
+			if err != nil {
+				return nil, err
+			}
+			e.added = append(e.added, meta)
+		case "del":
+			e.deleted = append(e.deleted, arg)
+		case "seq":
+			seq, err := strconv.ParseUint(arg, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad edit %q", line)
+			}
+			e.lastSeq = seq
+		default:
+			return nil, fmt.Errorf("bad edit %q", line)
+		}
+	}
+	return e, nil
+}
+
+// logEdit(e, v) appends e to the manifest, v being the version e results in.
+// Every MANIFEST_SNAPSHOT_EDITS edits the log is replaced by a snapshot of v.
+//
+// Call with manifestMu held.
+func (nob *Nob) logEdit(e *versionEdit, v *version) {
+	err := appendRecord(nob.manifest.file, e.encode())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	nob.manifest.edits++
+	if nob.manifest.edits >= nob.manifest.snapshotEvery {
+		if err := nob.writeManifestSnapshot(v); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// writeManifestSnapshot(v) atomically replaces the manifest with a single edit adding
+// every file of v, and reopens it for appending
+func (nob *Nob) writeManifestSnapshot(v *version) error {
+	manifestPath := path.Join(nob.rootDir, MANIFEST_NAME)
+	f, err := os.Create(manifestPath + TMP_SUFFIX)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(MANIFEST_MAGIC)
+	if err == nil {
+		// appendRecord syncs
+		err = appendRecord(f, (&versionEdit{added: v.all(), lastSeq: v.lastSeq}).encode())
+	}
+	if err == nil {
+		err = os.Rename(manifestPath+TMP_SUFFIX, manifestPath)
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	syncDir(nob.rootDir)
+
+	snapshotEvery := MANIFEST_SNAPSHOT_EDITS
+	if nob.manifest != nil {
+		_ = nob.manifest.file.Close()
+		snapshotEvery = nob.manifest.snapshotEvery
+	}
+	// f now is the manifest, already positioned at its end
+	nob.manifest = &manifestLog{file: f, snapshotEvery: snapshotEvery}
+	return nil
+}
+
+// loadManifest(rootDir) replays the manifest, returning false if there isn't one yet.
+// A torn last edit was never acknowledged and is dropped.
+func loadManifest(rootDir string) (*version, bool, error) {
+	f, err := os.OpenFile(path.Join(rootDir, MANIFEST_NAME), os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(MANIFEST_MAGIC))
+	_, err = io.ReadFull(f, magic)
+	if err != nil || string(magic) != MANIFEST_MAGIC {
+		return nil, false, errors.New("not a manifest")
+	}
+
+	v := &version{}
+	err = replayRecords(f, int64(len(MANIFEST_MAGIC)), func(payload []byte) error {
+		e, err := decodeEdit(payload)
+		if err != nil {
+			return err
+		}
+		v.apply(e)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+// formatFileMeta(meta) returns: level name size "smallest" "largest" smallestSeq largestSeq
+func formatFileMeta(meta *fileMeta) string {
+	return fmt.Sprintf("%v %v %v %v %v %v %v",
+		meta.level, meta.name, meta.size, strconv.Quote(meta.smallest), strconv.Quote(meta.largest),
+		meta.smallestSeq, meta.largestSeq)
+}
+
+// parseFileMeta(line) reads a line of formatFileMeta
+func parseFileMeta(line string) (*fileMeta, error) {
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bad line %q", line)
+	}
+	level, err := strconv.Atoi(parts[0])
+	if err != nil || level < 0 || level >= NUM_LEVELS {
+		return nil, fmt.Errorf("bad level in %q", line)
+	}
+	size, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	smallest, err := strconv.QuotedPrefix(parts[3])
+	if err != nil {
+		return nil, err
+	}
+	rest := strings.TrimPrefix(parts[3][len(smallest):], " ")
+	largest, err := strconv.QuotedPrefix(rest)
+	if err != nil {
+		return nil, err
+	}
+	meta := &fileMeta{name: parts[1], level: level, size: size}
+	if meta.smallest, err = strconv.Unquote(smallest); err != nil {
+		return nil, err
+	}
+	if meta.largest, err = strconv.Unquote(largest); err != nil {
+		return nil, err
+	}
+
+	smallestSeq, largestSeq, _ := strings.Cut(strings.TrimPrefix(rest[len(largest):], " "), " ")
+	if meta.smallestSeq, err = strconv.ParseUint(smallestSeq, 10, 64); err != nil {
+		return nil, err
+	}
+	if meta.largestSeq, err = strconv.ParseUint(largestSeq, 10, 64); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
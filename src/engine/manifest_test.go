@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+// manifestEdits(t, dir) decodes every edit of the manifest in dir
+func manifestEdits(t *testing.T, dir string) []*versionEdit {
+	t.Helper()
+	f, err := os.Open(path.Join(dir, MANIFEST_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(MANIFEST_MAGIC))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != MANIFEST_MAGIC {
+		t.Fatalf("manifest doesn't start with its magic, got %q", magic)
+	}
+
+	var edits []*versionEdit
+	for {
+		payload, _, err := readRecord(r, MAX_RECORD_SIZE)
+		if err == io.EOF {
+			return edits
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := decodeEdit(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edits = append(edits, e)
+	}
+}
+
+func levelNames(v *version) [NUM_LEVELS][]string {
+	var res [NUM_LEVELS][]string
+	for level, files := range v.levels {
+		for _, f := range files {
+			res[level] = append(res[level], f.name)
+		}
+	}
+	return res
+}
+
+func TestManifestLogsEdits(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	for i := range 100 {
+		_ = nob.Set(fmt.Sprintf("key%03d", i), "val")
+	}
+	nob.mergeCompact()
+
+	edits := manifestEdits(t, tdir)
+	// the startup snapshot, a flush per segment & the compactions
+	if len(edits) < 3 {
+		t.Fatalf("got %v edits", len(edits))
+	}
+	var deleted bool
+	for _, e := range edits {
+		deleted = deleted || len(e.deleted) > 0
+	}
+	if !deleted {
+		t.Fatal("compaction should've logged its inputs as deleted")
+	}
+
+	want := levelNames(nob.currentVersion())
+	_ = nob.Close()
+	restarted := getNob(t, tdir)
+	if got := levelNames(restarted.currentVersion()); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	// and replaying compacted it back to a snapshot
+	if n := len(manifestEdits(t, tdir)); n != 1 {
+		t.Fatalf("got %v edits after restart", n)
+	}
+}
+
+func TestManifestSnapshotsPeriodically(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	nob.manifestMu.Lock()
+	nob.manifest.snapshotEvery = 3
+	nob.manifestMu.Unlock()
+
+	for i := range 200 {
+		_ = nob.Set(fmt.Sprintf("key%03d", i), "val")
+	}
+	nob.waitForFlushes()
+	nob.runPendingCompactions()
+
+	if n := len(manifestEdits(t, tdir)); n > 3 {
+		t.Fatalf("got %v edits, should've been snapshotted", n)
+	}
+	want := levelNames(nob.currentVersion())
+	_ = nob.Close()
+	restarted := getNob(t, tdir)
+	if got := levelNames(restarted.currentVersion()); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestManifestTornEditIsDropped(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	for i := range 40 {
+		_ = nob.Set(fmt.Sprintf("key%03d", i), "val")
+	}
+	nob.waitForFlushes()
+	nob.runPendingCompactions()
+	want := levelNames(nob.currentVersion())
+	_ = nob.Close()
+
+	// a crash halfway through appending an edit
+	f, err := os.OpenFile(path.Join(tdir, MANIFEST_NAME), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte{0x01, 0x02, 0x03, 0x04, 0xff, 0x00})
+	_ = f.Close()
+
+	restarted := getNob(t, tdir)
+	if got := levelNames(restarted.currentVersion()); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	for i := range 40 {
+		if _, err := restarted.Get(fmt.Sprintf("key%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
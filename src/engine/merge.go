@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+// ErrMergeFailed is returned when the merge operator can't fold the operands of a key,
+// e.g. an increment of a value that isn't a number
+var ErrMergeFailed = errors.New("merge failed")
+
+// DEFAULT_APPEND_DELIMITER separates the values a StringAppendOperator loaded from options joins
+const DEFAULT_APPEND_DELIMITER = ","
+
+// MergeOperator folds merge operands into the value of a key. Operands come oldest first.
+// Folding must be associative: partially merging some operands first doesn't change
+// the result, as memtables and compactions do that whenever what they apply to is elsewhere.
+type MergeOperator interface {
+	// FullMerge(key, existing, exists, operands) applies operands to existing, the value of key,
+	// or to no value unless exists
+	FullMerge(key, existing string, exists bool, operands []string) (string, error)
+	// PartialMerge(key, operands) combines consecutive operands into one
+	PartialMerge(key string, operands []string) (string, error)
+}
+
+// errNotAnInt64 fails an Int64AddOperator on a value or operand that isn't a decimal int64.
+// Values & operands stay out of errors, they end up in logs.
+var errNotAnInt64 = errors.New("not a 64 bit integer")
+
+// Int64AddOperator keeps a signed 64 bit counter in decimal, operands are the amounts added.
+// A key with no value counts from 0, overflows wrap around.
+type Int64AddOperator struct{}
+
+func NewInt64AddOperator() *Int64AddOperator {
+	return &Int64AddOperator{}
+}
+
+func (o *Int64AddOperator) FullMerge(key, existing string, exists bool, operands []string) (string, error) {
+	var sum int64
+	if exists {
+		n, err := strconv.ParseInt(existing, 10, 64)
+		if err != nil {
+			return "", errNotAnInt64
+		}
+		sum = n
+	}
+	delta, err := o.sum(operands)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(sum+delta, 10), nil
+}
+
+func (o *Int64AddOperator) PartialMerge(key string, operands []string) (string, error) {
+	sum, err := o.sum(operands)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(sum, 10), nil
+}
+
+func (o *Int64AddOperator) sum(operands []string) (int64, error) {
+	var sum int64
+	for _, operand := range operands {
+		n, err := strconv.ParseInt(operand, 10, 64)
+		if err != nil {
+			return 0, errNotAnInt64
+		}
+		sum += n
+	}
+	return sum, nil
+}
+
+// StringAppendOperator appends operands to the value of a key, Delimiter in between
+type StringAppendOperator struct {
+	Delimiter string
+}
+
+func NewStringAppendOperator(delimiter string) *StringAppendOperator {
+	return &StringAppendOperator{Delimiter: delimiter}
+}
+
+func (o *StringAppendOperator) FullMerge(key, existing string, exists bool, operands []string) (string, error) {
+	joined := strings.Join(operands, o.Delimiter)
+	if !exists {
+		return joined, nil
+	}
+	return existing + o.Delimiter + joined, nil
+}
+
+func (o *StringAppendOperator) PartialMerge(key string, operands []string) (string, error) {
+	return strings.Join(operands, o.Delimiter), nil
+}
+
+// Merge(key, operand) records operand for the merge operator (see Options.MergeOperator)
+// to fold into the value of key, without reading it. Reads fold the operands written since
+// the last Set or Delete of key, memtables and compactions fold them ahead of reads.
+//
+// Operands apply to an expiring value until it expires, the result expiring with it,
+// and to no value from then on, whenever they were written.
+//
+// It fails with ErrMergeFailed, writing nothing, if the merge operator rejects operand on
+// its own, e.g. an increment that isn't a number. Whether operand applies to the value of
+// key is only found out by reads, which fail with ErrMergeFailed until key is set or deleted,
+// e.g. for an increment of a word.
+func (nob *Nob) Merge(key, operand string) error {
+	b := NewWriteBatch()
+	b.Merge(key, operand)
+	return nob.Write(b)
+}
+
+// Merge(key, operand) adds a Nob.Merge to b, operand being checked when b is written
+func (b *WriteBatch) Merge(key, operand string) {
+	b.entries = append(b.entries, util.Entry{Key: key, Value: string(MERGE_MARKER) + operand})
+}
+
+// checkOperands(b) fails with ErrMergeFailed if the merge operator rejects an operand of b,
+// before anything is written
+func (nob *Nob) checkOperands(b *WriteBatch) error {
+	for _, e := range b.entries {
+		if e.Value[0] != MERGE_MARKER {
+			continue
+		}
+		if _, err := partialMerge(nob.opts.MergeOperator, e.Key, []string{e.Value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fullMerge(op, key, operands, base, hasBase) folds the marked merge operands of key,
+// newest first, into base, the marked version of key older than all of them, or into no
+// value unless hasBase. It returns the marked result.
+//
+// Operands apply to no value past a tombstone or an expired value, an expiring value
+// keeps its expiry.
+func fullMerge(op MergeOperator, key string, operands []string, base string, hasBase bool) (string, error) {
+	var existing string
+	var exists bool
+	if hasBase {
+		existing, exists = unmarkValue(base)
+	}
+	val, err := op.FullMerge(key, existing, exists, unmarkOperands(operands))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v: %v", ErrMergeFailed, key, err)
+	}
+	if exists && base[0] == EXPIRING_MARKER {
+		_, expiry := splitExpiring(base)
+		return markExpiring(val, expiry), nil
+	}
+	return string(VALUE_MARKER) + val, nil
+}
+
+// foldsInto(base) reports whether operands can be folded into base ahead of reads.
+// A live expiring value can't: once it expires, the operands apply to no value instead.
+func foldsInto(base string) bool {
+	if base[0] != EXPIRING_MARKER {
+		return true
+	}
+	_, live := unmarkValue(base)
+	return !live
+}
+
+// partialMerge(op, key, operands) combines the marked merge operands of key, newest
+// first, into a single marked operand
+func partialMerge(op MergeOperator, key string, operands []string) (string, error) {
+	operand, err := op.PartialMerge(key, unmarkOperands(operands))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v: %v", ErrMergeFailed, key, err)
+	}
+	return string(MERGE_MARKER) + operand, nil
+}
+
+// unmarkOperands(operands) unmarks operands, newest first, into the oldest first order
+// operators take
+func unmarkOperands(operands []string) []string {
+	unmarked := make([]string, len(operands))
+	for i, operand := range operands {
+		unmarked[len(operands)-1-i] = operand[1:]
+	}
+	return unmarked
+}
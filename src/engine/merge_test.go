@@ -0,0 +1,222 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+func TestMergeAddsToCounters(t *testing.T) {
+	// a util.SkipList can't fold operands on insert, reads fold all of them
+	memtables := map[string]func() util.OrderedMap{
+		"avl":      func() util.OrderedMap { return util.NewAVLMap() },
+		"skiplist": func() util.OrderedMap { return util.NewSkipList() },
+	}
+	for name, newMemtable := range memtables {
+		t.Run(name, func(t *testing.T) {
+			opts := testOptions(testLeveledStrategy())
+			opts.NewMemtable = newMemtable
+			nob := getNobWithOptions(t, t.TempDir(), opts)
+			if err := nob.Merge("fresh", "1"); err != nil {
+				t.Fatal(err)
+			}
+			_ = nob.Set("counter", "10")
+			_ = nob.Merge("counter", "5")
+			_ = nob.Merge("counter", "-3")
+			_ = nob.Set("gone", "7")
+			_ = nob.Delete("gone")
+			_ = nob.Merge("gone", "2")
+
+			for key, want := range map[string]string{"fresh": "1", "counter": "12", "gone": "2"} {
+				if got, err := nob.Get(key); err != nil || got != want {
+					t.Fatalf("%v: got %v %v, want %v", key, got, err, want)
+				}
+			}
+			if got := collect(nob.Scan("", "")); fmt.Sprint(got) != "map[counter:12 fresh:1 gone:2]" {
+				t.Fatalf("scanned %v", got)
+			}
+
+			if err := nob.Merge("counter", "lots"); !errors.Is(err, ErrMergeFailed) {
+				t.Fatalf("bad operand got %v", err)
+			}
+		})
+	}
+}
+
+func TestMergeOfAWordFailsReads(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("a", "1")
+	_ = nob.Set("word", "hello")
+	_ = nob.Set("z", "26")
+	// the operand is fine on its own, the value it applies to isn't read
+	if err := nob.Merge("word", "1"); err != nil {
+		t.Fatal(err)
+	}
+	b := NewWriteBatch()
+	b.Merge("word", "2")
+	if err := nob.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := nob.Get("word"); !errors.Is(err, ErrMergeFailed) {
+		t.Fatalf("got %v", err)
+	}
+	it := nob.Scan("", "")
+	defer it.Close()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if fmt.Sprint(keys) != "[a z]" || it.Err() != nil {
+		t.Fatalf("scanned %v, err %v", keys, it.Err())
+	}
+	if err := it.Failed()["word"]; len(it.Failed()) != 1 || !errors.Is(err, ErrMergeFailed) {
+		t.Fatalf("failed %v", it.Failed())
+	}
+
+	// a set ends it
+	_ = nob.Set("word", "5")
+	if got, err := nob.Get("word"); err != nil || got != "5" {
+		t.Fatalf("got %v %v", got, err)
+	}
+}
+
+func TestStringAppendOperator(t *testing.T) {
+	opts := testOptions(testLeveledStrategy())
+	opts.MergeOperator = NewStringAppendOperator(",")
+	nob := getNobWithOptions(t, t.TempDir(), opts)
+	_ = nob.Set("tags", "a")
+	_ = nob.Merge("tags", "b")
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("junk%02d", i), "values")
+	}
+	nob.waitForFlushes()
+	_ = nob.Merge("tags", "c")
+	_ = nob.Merge("new", "x")
+
+	if got, err := nob.Get("tags"); err != nil || got != "a,b,c" {
+		t.Fatalf("got %v %v", got, err)
+	}
+	if got, err := nob.Get("new"); err != nil || got != "x" {
+		t.Fatalf("got %v %v", got, err)
+	}
+}
+
+func TestCompactionFoldsOperands(t *testing.T) {
+	tdir := t.TempDir()
+	// a full size-tiered compaction rewrites everything into a single file
+	nob := getNobWithStrategy(t, tdir, NewSizeTieredStrategy())
+	_ = nob.Set("counter", "100")
+	for round := range 5 {
+		for range 3 {
+			_ = nob.Merge("counter", "1")
+		}
+		for i := range 20 {
+			_ = nob.Set(fmt.Sprintf("junk%v-%02d", round, i), "values")
+		}
+		nob.waitForFlushes()
+		if got, err := nob.Get("counter"); err != nil || got != fmt.Sprint(103+3*round) {
+			t.Fatalf("round %v: got %v %v", round, got, err)
+		}
+	}
+	nob.mergeCompact()
+
+	var versions []string
+	for _, f := range nob.currentVersion().all() {
+		table, err := openSSTable(path.Join(nob.rootDir, f.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		it := table.iterator("counter")
+		for it.next() {
+			if userKeyOf(it.key()) == "counter" {
+				versions = append(versions, it.raw())
+			}
+		}
+		it.close()
+	}
+	if fmt.Sprint(versions) != "[+115]" {
+		t.Fatalf("counter compacted into %q", versions)
+	}
+	_ = nob.Close()
+
+	restarted := getNob(t, tdir)
+	_ = restarted.Merge("counter", "1")
+	if got, err := restarted.Get("counter"); err != nil || got != "116" {
+		t.Fatalf("got %v %v after restart", got, err)
+	}
+}
+
+func TestSnapshotReadsOperandsAsOfIt(t *testing.T) {
+	nob := getNobWithStrategy(t, t.TempDir(), NewSizeTieredStrategy())
+	for range 3 {
+		_ = nob.Merge("counter", "1")
+	}
+	snap := nob.Snapshot()
+	defer snap.Release()
+	for range 3 {
+		_ = nob.Merge("counter", "1")
+	}
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("junk%02d", i), "values")
+	}
+	nob.mergeCompact()
+
+	if got, err := snap.Get("counter"); err != nil || got != "3" {
+		t.Fatalf("snapshot got %v %v", got, err)
+	}
+	if got := collect(snap.Scan("counter", "d")); fmt.Sprint(got) != "map[counter:3]" {
+		t.Fatalf("snapshot scanned %v", got)
+	}
+	if got, err := nob.Get("counter"); err != nil || got != "6" {
+		t.Fatalf("got %v %v", got, err)
+	}
+}
+
+func TestMergeKeepsExpiry(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.SetWithTTL("requests", "0", 100*time.Millisecond)
+	_ = nob.Merge("requests", "1")
+	if got, err := nob.Get("requests"); err != nil || got != "1" {
+		t.Fatalf("got %v %v", got, err)
+	}
+	if ttl, err := nob.TTL("requests"); err != nil || ttl == NO_TTL {
+		t.Fatalf("ttl %v %v", ttl, err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if got, err := nob.Get("requests"); err != nil || got != "1" {
+		t.Fatalf("got %v %v after expiry", got, err)
+	}
+	_ = nob.Merge("requests", "1")
+	if got, err := nob.Get("requests"); err != nil || got != "2" {
+		t.Fatalf("got %v %v", got, err)
+	}
+}
+
+func TestConcurrentMergesArentLost(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 25 {
+				_ = nob.Set(fmt.Sprintf("noise%v-%v", w, i), "values")
+				if err := nob.Merge("counter", "1"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, _ := nob.Get("counter"); got != "200" {
+		t.Fatalf("got %v after 200 increments", got)
+	}
+}
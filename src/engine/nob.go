@@ -8,330 +8,502 @@ import (
 	"log"
 	"os"
 	"path"
-	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.target.com/eric.miranda/mydb/v2/src/util"
 )
 
-const COMPACTED_PREFIX = "^compacted"
-const SEGMENT_PREFIX = "^seg"
+// memtable values are prefixed with a marker so a delete can shadow older segments
+const VALUE_MARKER = '+'
+const TOMBSTONE_MARKER = '-'
+
+// EXPIRING_MARKER values carry their expiry before the value, see markExpiring
+const EXPIRING_MARKER = '~'
+
+// MERGE_MARKER values are merge operands, see Merge
+const MERGE_MARKER = '*'
+
+var ErrKeyNotFound = errors.New("nokey")
 
 type Nob struct {
-	memtable    *util.TreeMap
-	rootDir     string
-	segmentSize int64
-	segNo       int
-	blockSize   int64
+	memtable util.OrderedMap
+	rootDir  string
+	segNo    int
+	wal      *wal
+	version  *version
+	manifest *manifestLog
+	// opts are fixed once opened
+	opts Options
+
+	// mu guards memtable, version, segNo, file refs & snapshots. It is only held for short
+	// steps, never across I/O, so readers don't wait on flushes or compactions.
+	// Readers only read lock it. Writers to a memtable safe for concurrent use don't lock
+	// it at all, see insertAll.
+	mu sync.RWMutex
+	// lastSeq numbers the latest write, changed with writeMu held once the write is in
+	// the memtable. Reads are clamped to it so they never see half a batch.
+	lastSeq atomic.Uint64
+	// snapshots holds the sequence number of every live Snapshot, ascending
+	snapshots []uint64
+	// immutables are full memtables waiting for the flusher, newest first
+	immutables []*immutableMemtable
+	// queueChanged is signalled, with mu, when immutables grows or shrinks
+	queueChanged *sync.Cond
+	closing      bool
+	flusherDone  chan struct{}
+	// writeMu serialises writers, see Write
+	writeMu sync.Mutex
+	// pendingMu guards pending, the batches waiting for a group commit
+	pendingMu sync.Mutex
+	pending   []*pendingWrite
+	// compactMu serialises compactions, guarding compactPointer
+	compactMu sync.Mutex
+	// compactPointer holds, by level, the largest key of the last compaction out of it
+	compactPointer [NUM_LEVELS]string
+	// manifestMu serialises version edits, guarding manifest
+	manifestMu sync.Mutex
+
+	wake      chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
 }
 
-type Anchor struct {
-	key    string
-	offset int64
+// NewNob(rootDir) opens a Nob with DefaultOptions()
+func NewNob(rootDir string) *Nob {
+	nob, err := NewNobWithOptions(rootDir, DefaultOptions())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return nob
 }
 
-func NewNob(rootDir string) *Nob {
-	n := Nob{memtable: nil, rootDir: rootDir, segmentSize: 100, segNo: 0, blockSize: 10}
+// NewNobWithOptions(rootDir, opts) opens a Nob tuned by opts, failing if they're invalid.
+// Compression & bloom filter settings only apply to segments written from then on,
+// existing segments keep theirs until they are compacted.
+func NewNobWithOptions(rootDir string, opts Options) (*Nob, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %w", err)
+	}
+	if opts.Strategy == nil {
+		opts.Strategy = NewLeveledStrategy()
+	}
+	if opts.NewMemtable == nil {
+		opts.NewMemtable = func() util.OrderedMap { return util.NewAVLMap() }
+	}
+	if opts.MergeOperator == nil {
+		opts.MergeOperator = NewInt64AddOperator()
+	}
+	n := Nob{memtable: nil, rootDir: rootDir, segNo: 0, opts: opts}
+	n.queueChanged = sync.NewCond(&n.mu)
 	// todo(): build
 	//n.memtable = buildIndexOf(dbfile)
-	n.memtable = util.NewTreeMap()
-	//ticker := time.NewTicker(time.Second * 10)
-	ticker := time.NewTicker(time.Hour * 10)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				fmt.Println("====beginning compaction====")
-				n.mergeCompact()
-				fmt.Println("====compact complete====")
-			}
-		}
-	}()
-	return &n
-}
+	n.memtable = opts.NewMemtable()
 
-func (nob *Nob) Set(key string, val string) {
-	nob.memtable.Insert(key, val)
-	if nob.memtable.GetSize() > 150 {
-		nob.createSegment()
+	err := os.MkdirAll(rootDir, 0755)
+	if err != nil {
+		return nil, err
 	}
-}
-
-// Get(key) searches in the following steps
-//
-// 1. check in memory
-//
-// 2. get segfiles / compactedfiles in order of creation
-//
-// 3. search latest, latest-1, latest-2...
-func (nob *Nob) Get(key string) (string, error) {
-	val, exists := nob.memtable.Get(key)
-	if exists {
-		log.Println("found key", key, "value: ", val)
-		return val, nil
+	report, err := n.recover()
+	if err != nil {
+		return nil, fmt.Errorf("recovering %v: %w", rootDir, err)
+	}
+	// the manifest is open from here on
+	fail := func(err error) (*Nob, error) {
+		_ = n.manifest.file.Close()
+		return nil, err
+	}
+	log.Println("recovered segments:", report.live, "quarantined:", report.quarantined)
+	n.lastSeq.Store(n.version.lastSeq)
+	if err := n.recoverFrozenMemtables(); err != nil {
+		return fail(fmt.Errorf("replaying frozen memtables: %w", err))
 	}
 
-	segFiles := nob.getOrderedSegFiles(SEGMENT_PREFIX, false)
-	log.Println("segfiles: ", segFiles)
-
-	// i'm thinking if compaction ran, any existing segfile would be newer
-	val, err := nob.searchSegments(key, segFiles)
+	w, err := openWal(rootDir)
 	if err != nil {
-		return "", errors.New("nokey")
+		return fail(err)
 	}
+	err = w.replay(n.replayInto(n.memtable))
+	if err != nil {
+		_ = w.close()
+		return fail(fmt.Errorf("replaying wal: %w", err))
+	}
+	n.wal = w
 
-	return val, nil
+	n.startFlusher()
+	n.startScheduler(opts.CompactionInterval)
+	return &n, nil
 }
 
-func (nob *Nob) searchSegments(key string, segFiles []string) (string, error) {
-	for _, segFile := range segFiles {
-		// todo(first)
-		// get indx file
-		indexFile, err := os.Open(
-			path.Join(nob.rootDir, fmt.Sprintf("indx_%v", filepath.Base(segFile))),
-		)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		// get lower offset
-		segFile, err := os.Open(segFile)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		fileInfo, err := segFile.Stat()
-		if err != nil {
-			log.Fatalln(err)
-		}
+// Close() waits for a running compaction and the queued flushes to finish,
+// then releases the wal. The memtable isn't flushed, the wal replays it on the next start.
+func (nob *Nob) Close() error {
+	var err error
+	nob.closeOnce.Do(func() {
+		close(nob.stop)
+		<-nob.stopped
+
+		nob.mu.Lock()
+		nob.closing = true
+		nob.queueChanged.Broadcast()
+		nob.mu.Unlock()
+		<-nob.flusherDone
+
+		nob.manifestMu.Lock()
+		_ = nob.manifest.file.Close()
+		nob.manifestMu.Unlock()
+
+		nob.writeMu.Lock()
+		defer nob.writeMu.Unlock()
+		err = nob.wal.close()
+	})
+	return err
+}
 
-		lowerOffset, upperOffset := getOffsets(key, indexFile, fileInfo.Size())
-		fmt.Println("Offsets", lowerOffset, upperOffset)
-		// search segFileName from loweroffset .. upperOffset
-		val, err := searchFile(key, lowerOffset, upperOffset, segFile)
-		if err == nil {
-			return val, nil
-		}
-	}
+// Set(key, val) is durable once it returns without error: the write is
+// synced to the wal before it reaches the memtable
+func (nob *Nob) Set(key string, val string) error {
+	return nob.put(key, string(VALUE_MARKER)+val)
+}
 
-	return "", errors.New("no key in segfiles found")
+// Delete(key) writes a tombstone, which hides key in every older segment
+// until compaction drops both
+func (nob *Nob) Delete(key string) error {
+	return nob.put(key, string(TOMBSTONE_MARKER))
 }
 
-// getOffsets() returns lowerbound & upperbound to search within
-func getOffsets(key string, indexFile *os.File, segFileSize int64) (int64, int64) {
-	// todo
-	indxSlice := loadSparseIndex(indexFile)
-	s := 0
-	e := len(indxSlice)
+// put(key, raw) logs & inserts an already marked memtable value
+func (nob *Nob) put(key string, raw string) error {
+	return nob.Write(&WriteBatch{entries: []util.Entry{{Key: key, Value: raw}}})
+}
 
-	for s < e {
-		m := ((e - s) / 2) + s
+// insert(memtable, key, seq, raw) adds the version of key written at seq. Older versions
+// in the same stripe can't be read anymore, they're dropped so overwriting a key
+// doesn't grow the memtable, unless it can't delete (a util.SkipList).
+//
+// Call with mu held if memtable is live, unless it is Concurrent().
+func (nob *Nob) insert(memtable util.OrderedMap, key string, seq uint64, raw string) {
+	memtable.Insert(makeInternalKey(key, seq), raw)
+	d, ok := memtable.(interface{ Delete(key string) bool })
+	if !ok {
+		return
+	}
 
-		if indxSlice[m].key > key {
-			e = m
-		} else {
-			s = m + 1
+	// the versions of key by stripe, newest first
+	var stripes [][]util.Entry
+	stripe := -1
+	it := memtable.Seek(makeInternalKey(key, seq))
+	for it.Next() {
+		k, s := parseInternalKey(it.Key())
+		if k != key {
+			break
 		}
+		if st := stripeOf(nob.snapshots, s); st != stripe {
+			stripes = append(stripes, nil)
+			stripe = st
+		}
+		stripes[len(stripes)-1] = append(stripes[len(stripes)-1], util.Entry{Key: it.Key(), Value: it.Value()})
 	}
-
-	if e == 0 {
-		return 0, indxSlice[0].offset
-	} else if e == len(indxSlice) {
-		return indxSlice[e-1].offset, segFileSize
-	} else {
-		return indxSlice[e-1].offset, indxSlice[e].offset
+	for _, versions := range stripes {
+		nob.pruneStripe(memtable, d, key, versions)
 	}
 }
 
-func searchFile(needle string, lowerOffset, upperOffset int64, segFile *os.File) (string, error) {
-	currentOffset, err := segFile.Seek(lowerOffset, 0)
-	if err != nil {
-		log.Fatalln(err)
+// pruneStripe(memtable, d, key, versions) keeps only the newest of versions, the versions
+// of key in a stripe, newest first. Merge operands are folded into it first, if the merge
+// operator fails on them they're all kept. Operands aren't folded into an expiring value,
+// which is kept too, see foldsInto.
+func (nob *Nob) pruneStripe(memtable util.OrderedMap, d interface{ Delete(key string) bool }, key string, versions []util.Entry) {
+	if len(versions) < 2 {
+		return
 	}
-	reader := bufio.NewReader(segFile)
-
-	for currentOffset < upperOffset {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			log.Fatalln(err)
+	if newest := versions[0]; newest.Value[0] == MERGE_MARKER {
+		operands := []string{newest.Value}
+		i := 1
+		for i < len(versions) && versions[i].Value[0] == MERGE_MARKER {
+			operands = append(operands, versions[i].Value)
+			i++
 		}
-		log.Println("line is", line)
-		kvpair := strings.Split(line, " ")
-		key, val := kvpair[0], kvpair[1]
-		if key == needle {
-			return val, nil
+		var raw string
+		var err error
+		stale := versions[1:]
+		if i < len(versions) && foldsInto(versions[i].Value) {
+			raw, err = fullMerge(nob.opts.MergeOperator, key, operands, versions[i].Value, true)
+		} else {
+			// what they apply to may be in an older memtable or segment
+			raw, err = partialMerge(nob.opts.MergeOperator, key, operands)
+			stale = versions[1:i:i]
+			if i < len(versions) {
+				stale = append(stale, versions[i+1:]...)
+			}
+		}
+		if err != nil {
+			return
 		}
+		memtable.Insert(newest.Key, raw)
+		versions = stale
+	} else {
+		versions = versions[1:]
+	}
+	for _, e := range versions {
+		d.Delete(e.Key)
+	}
+}
 
-		currentOffset += int64(len(line))
+// memtableGet(memtable, key, seq) returns the marked value & sequence number of the
+// newest version of key written at or before seq
+func memtableGet(memtable util.OrderedMap, key string, seq uint64) (string, uint64, bool) {
+	it := memtable.Seek(makeInternalKey(key, seq))
+	if it.Next() && userKeyOf(it.Key()) == key {
+		return it.Value(), seqOf(it.Key()), true
 	}
-	return "", nil
+	return "", 0, false
 }
 
-func (nob *Nob) mergeCompact() {
-	orderedSegFileNames := nob.getOrderedSegFiles(SEGMENT_PREFIX, true)
-	log.Println("segnames", orderedSegFileNames)
-	var segFiles []*os.File
-	for _, f := range orderedSegFileNames {
-		of, _ := os.Open(f)
-		segFiles = append(segFiles, of)
-	}
-	compactedKeyValues, ok := nob.compact(segFiles...)
-	if !ok {
-		log.Println("no segFiles to compact")
-		return
+// unmarkValue(raw) returns the value and whether it is live (not a tombstone or expired).
+// Merge operands must be folded first, see fullMerge.
+func unmarkValue(raw string) (string, bool) {
+	if raw[0] == EXPIRING_MARKER {
+		val, expiry := splitExpiring(raw)
+		return val, time.Now().Before(expiry)
 	}
+	return raw[1:], raw[0] == VALUE_MARKER
+}
+
+// Get(key) searches in the following steps
+//
+// 1. check the memtable, then the immutable memtables waiting to be flushed, newest first
+//
+// 2. get every L0 file and the one file per level below that covers key
+//
+// 3. search them by the latest write they hold, until the version found is newer than
+// anything the rest hold
+//
+// a tombstone as the newest version ends the search with ErrKeyNotFound
+//
+// segments are searched without holding any lock, the version pinned
+// alongside the memtable lookup keeps its files from being deleted
+func (nob *Nob) Get(key string) (string, error) {
+	return nob.get(key, MAX_SEQUENCE)
+}
+
+// GetAt(key, seq) is Get reading the newest version of key written at or before seq.
+//
+// Compactions only keep the versions the latest reads and live snapshots need, so an
+// older seq reads reliably only while a Snapshot of it (see Snapshot.Seq) is held.
+func (nob *Nob) GetAt(key string, seq uint64) (string, error) {
+	return nob.get(key, seq)
+}
 
-	nob.segNo = 0
-	// todo(bug): using seg number will rewrite compacted segFiles when its reset
-	// todo(can look into level / size-tiered compaction)
-	compactedSegName := fmt.Sprintf("compacted_%v", nob.allocateSeg())
-	compactedSegWritePath := path.Join(nob.rootDir, compactedSegName)
-	compactedSegFile, err := os.Create(compactedSegWritePath)
+// LastSequence() numbers the latest write, every write takes the next number
+func (nob *Nob) LastSequence() uint64 {
+	return nob.lastSeq.Load()
+}
+
+// get(key, seq) is GetAt
+func (nob *Nob) get(key string, seq uint64) (string, error) {
+	raw, _, found, err := nob.lookup(key, seq)
 	if err != nil {
-		log.Fatalln(err)
+		return "", err
+	}
+	if !found {
+		return "", ErrKeyNotFound
 	}
-	defer func(f *os.File) {
-		err := f.Close()
-		if err != nil {
-			log.Fatalln(err)
-		}
-	}(compactedSegFile)
 
-	for k, v := range compactedKeyValues {
-		_, _ = io.WriteString(compactedSegFile, fmt.Sprintf("%v %v\n", k, v))
+	val, live := unmarkValue(raw)
+	if !live {
+		return "", ErrKeyNotFound
 	}
+	return val, nil
+}
 
-	nob.createFileAndSparseIndex(compactedSegFile)
+// lookup(key, seq) returns the marked value of key as of seq, which may be a tombstone,
+// and the sequence number of its newest version. Merge operands are folded into the
+// version they apply to.
+func (nob *Nob) lookup(key string, seq uint64) (string, uint64, bool, error) {
+	raw, rawSeq, found, err := nob.lookupVersion(key, seq)
+	if err != nil || !found || raw[0] != MERGE_MARKER {
+		return raw, rawSeq, found, err
+	}
 
-	// delete segFiles
-	for _, oldSeg := range orderedSegFileNames {
-		err = os.Remove(oldSeg)
+	operands := []string{raw}
+	for at := rawSeq; at > 0; {
+		base, baseSeq, ok, err := nob.lookupVersion(key, at-1)
 		if err != nil {
-			log.Fatalln(err)
+			return "", 0, false, err
 		}
-		err = os.Remove(path.Join(nob.rootDir, fmt.Sprintf("indx_%v", path.Base(oldSeg))))
-		if err != nil {
-			log.Fatalln(err)
+		if !ok {
+			break
+		}
+		if base[0] != MERGE_MARKER {
+			raw, err = fullMerge(nob.opts.MergeOperator, key, operands, base, true)
+			return raw, rawSeq, err == nil, err
 		}
+		operands = append(operands, base)
+		at = baseSeq
 	}
+	raw, err = fullMerge(nob.opts.MergeOperator, key, operands, "", false)
+	return raw, rawSeq, err == nil, err
 }
 
-// getOrderedSegFiles(pattern string, asc bool) returns absolute filepaths matching pattern sorted by asc
-func (nob *Nob) getOrderedSegFiles(pattern string, asc bool) []string {
-	dirFiles, _ := os.ReadDir(nob.rootDir)
-
-	var res []string
-	for _, file := range dirFiles {
-		if ok, _ := regexp.MatchString(pattern, file.Name()); ok {
-			res = append(res, path.Join(nob.rootDir, file.Name()))
+// writtenSince(keys, at) reports whether one of keys has a version newer than at, only
+// reading the memtables. ok is false if such a version may have been flushed already.
+// Call with writeMu held, so no write is in progress.
+func (nob *Nob) writtenSince(keys []string, at uint64) (written bool, ok bool) {
+	nob.mu.RLock()
+	defer nob.mu.RUnlock()
+	// segments only hold writes up to the lastSeq of the version, later ones are in memtables
+	if nob.version.lastSeq > at {
+		return false, false
+	}
+	memtables := []util.OrderedMap{nob.memtable}
+	for _, imm := range nob.immutables {
+		memtables = append(memtables, imm.memtable)
+	}
+	for _, key := range keys {
+		for _, memtable := range memtables {
+			if _, seq, found := memtableGet(memtable, key, MAX_SEQUENCE); found && seq > at {
+				return true, true
+			}
 		}
 	}
+	return false, true
+}
 
-	sort.Slice(res, func(i, j int) bool {
-		f1name, f2name := path.Base(res[i]), path.Base(res[j])
-		f1no, err := strconv.Atoi(strings.Split(f1name, "_")[1])
-		if err != nil {
-			log.Fatalln(err)
-		}
-		f2no, err := strconv.Atoi(strings.Split(f2name, "_")[1])
-		if err != nil {
-			log.Fatalln(err)
-		}
-		if asc {
-			return f1no < f2no
-		} else {
-			return f2no < f1no
+// lookupVersion(key, seq) returns the marked value & sequence number of the newest version
+// of key written at or before seq, which may be a tombstone or a merge operand.
+// Memtables only hold writes newer than every segment, so the first one with a
+// version of key has the newest.
+func (nob *Nob) lookupVersion(key string, seq uint64) (string, uint64, bool, error) {
+	nob.mu.RLock()
+	// writes in progress are skipped, a concurrent memtable takes them without mu, so the
+	// read lock only waits on memtables being frozen & versions being swapped
+	seq = min(seq, nob.lastSeq.Load())
+	raw, rawSeq, exists := memtableGet(nob.memtable, key, seq)
+	for _, imm := range nob.immutables {
+		if exists {
+			break
 		}
-	})
-	return res
-}
+		raw, rawSeq, exists = memtableGet(imm.memtable, key, seq)
+	}
+	v := nob.version
+	if !exists {
+		v.ref()
+	}
+	nob.mu.RUnlock()
 
-// compact returns false if no segment files exist
-func (nob *Nob) compact(files ...*os.File) (map[string]string, bool) {
-	if len(files) == 0 {
-		return nil, false
+	if exists {
+		return raw, rawSeq, true, nil
 	}
-	hashMap := map[string]string{}
 
-	for _, file := range files {
-		sc := bufio.NewScanner(file)
+	defer nob.releaseVersion(v)
 
-		for sc.Scan() {
-			kv := strings.Split(sc.Text(), " ")
-			key, value := kv[0], kv[1]
-			hashMap[key] = value
+	var segFiles []*fileMeta
+	for _, f := range v.candidates(key) {
+		if f.mayContain(key) {
+			segFiles = append(segFiles, f)
 		}
 	}
+	sortBySeq(segFiles)
 
-	return hashMap, true
+	return nob.searchSegments(key, seq, segFiles)
 }
 
-// createSegment() creates a segment file with seg_{segNo} format
-func (nob *Nob) createSegment() {
-	// get segName
-	segName := fmt.Sprintf("seg_%v", nob.allocateSeg())
-
-	// write to segment
-	segFile, err := os.Create(path.Join(nob.rootDir, segName))
-	defer func(segfile *os.File) {
-		err := segfile.Close()
+// searchSegments(key, seq, segFiles) returns the marked value & sequence number of the
+// newest version of key as of seq.
+// segFiles are ordered by largestSeq, so once a version is found only files holding
+// later writes are searched. Of versions as old as sequence number 0, which files written
+// before sequence numbers hold, the first file's wins.
+func (nob *Nob) searchSegments(key string, seq uint64, segFiles []*fileMeta) (string, uint64, bool, error) {
+	var newest string
+	var newestSeq uint64
+	var found bool
+	for _, f := range segFiles {
+		if found && f.largestSeq <= newestSeq {
+			break
+		}
+		raw, rawSeq, ok, err := nob.searchSegment(key, seq, path.Join(nob.rootDir, f.name))
 		if err != nil {
-			log.Fatalln(err)
+			return "", 0, false, err
+		}
+		if ok && (!found || rawSeq > newestSeq) {
+			newest, newestSeq, found = raw, rawSeq, true
 		}
-	}(segFile)
-	if err != nil {
-		log.Fatalln(err)
 	}
+	return newest, newestSeq, found, nil
+}
 
-	nob.createFileAndSparseIndex(segFile)
+// searchSegment(key, seq, segFile) returns the marked value & sequence number of key as of
+// seq in a single segment
+func (nob *Nob) searchSegment(key string, seq uint64, segFile string) (string, uint64, bool, error) {
+	table, err := openSSTable(segFile)
+	if err == nil {
+		defer table.close()
+		return table.get(key, seq)
+	}
+	if err != errNotSSTable {
+		return "", 0, false, err
+	}
+	records, err := readTextSegment(segFile)
+	if err != nil {
+		return "", 0, false, err
+	}
+	raw, rawSeq, found := memtableGet(records, key, seq)
+	return raw, rawSeq, found, nil
+}
 
-	// start write to new memtable
-	nob.memtable = util.NewTreeMap()
+// parseRecord(line) splits a segment line into key & value.
+// A tombstone is written as a key without a value.
+func parseRecord(line string) (string, string, bool) {
+	return strings.Cut(strings.TrimSuffix(line, "\n"), " ")
 }
 
-// createSparseIndx(segFile) creates an index file with indx_{segFile} format
-func (nob *Nob) createFileAndSparseIndex(segFile *os.File) {
-	sparseIndx := map[string]int64{}
-	orderedKv := nob.memtable.GetInorder()
-	currentBlock := int64(0)
-	for _, kv := range orderedKv {
-		offset, err := segFile.Seek(0, io.SeekCurrent)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		if offset/nob.blockSize > currentBlock {
-			sparseIndx[kv.Key] = offset
-			currentBlock = offset
-		}
-		_, err = segFile.WriteString(fmt.Sprintf("%v %v\n", kv.Key, kv.Value))
-		if err != nil {
-			log.Fatalln(err)
-		}
+// mergeCompact() compacts all of L0, including memtables queued for flushing,
+// then whatever else the strategy picks until it's satisfied
+func (nob *Nob) mergeCompact() {
+	nob.waitForFlushes()
+
+	nob.compactMu.Lock()
+	if c := nob.pickCompaction(true); c != nil {
+		nob.runCompaction(c)
+	} else {
+		log.Println("no segFiles to compact")
 	}
+	nob.compactMu.Unlock()
 
-	// write to indx
-	sparseIndxFile, err := os.Create(path.Join(nob.rootDir, fmt.Sprintf("indx_%v", filepath.Base(segFile.Name()))))
-	if err != nil {
-		log.Fatalln(err)
+	nob.runPendingCompactions()
+}
+
+// compact(segFiles...) k-way merges segFiles, newest first, into a single sorted
+// stream holding the latest version of every key, and the versions live snapshots read.
+// It returns false if no segment files exist.
+//
+// segFiles must include the oldest live segment, as deleted keys are left out of the result
+func (nob *Nob) compact(segFiles ...string) (recordIterator, bool) {
+	if len(segFiles) == 0 {
+		return nil, false
 	}
-	defer func(indxFile *os.File) {
-		err := indxFile.Close()
-		if err != nil {
-			log.Fatalln()
-		}
-	}(sparseIndxFile)
 
-	for k, v := range sparseIndx {
-		_, err = sparseIndxFile.WriteString(fmt.Sprintf("%v %v\n", k, v))
-		if err != nil {
-			log.Fatalln(err)
-		}
+	return nob.newVersionFilter(nob.mergeFiles(segFiles), true), true
+}
+
+// mergeFiles(segFiles) k-way merges segFiles, newest first, keeping tombstones
+func (nob *Nob) mergeFiles(segFiles []string) *mergingIterator {
+	var sources []recordIterator
+	for _, segFile := range segFiles {
+		sources = append(sources, nob.newSegmentIterator(segFile, ""))
 	}
+	return newMergingIterator(sources)
 }
 
 func (nob *Nob) allocateSeg() int {
+	nob.mu.Lock()
+	defer nob.mu.Unlock()
 	nob.segNo += 1
 	return nob.segNo
 }
@@ -410,29 +582,6 @@ func getOldIndexes(dir string) []os.DirEntry {
 	return res
 }
 
-// returns an array of anchors sorted by key asc
-func loadSparseIndex(f *os.File) []*Anchor {
-	res := []*Anchor{}
-	sc := bufio.NewScanner(f)
-
-	for sc.Scan() {
-		line := sc.Text()
-		kvpair := strings.Split(line, " ")
-		key, offsetString := kvpair[0], kvpair[1]
-		offset, err := strconv.ParseInt(offsetString, 10, 64)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		anchor := &Anchor{
-			key:    key,
-			offset: offset,
-		}
-		res = append(res, anchor)
-	}
-
-	return res
-}
-
 // loadIndexFrom(file) loads an index from disk into memory
 func loadIndexFrom(f *os.File) map[string]int64 {
 	res := map[string]int64{}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"maps"
@@ -8,7 +9,6 @@ import (
 	"path"
 	"regexp"
 	"slices"
-	"strconv"
 	"strings"
 	"testing"
 )
@@ -19,7 +19,7 @@ func init() {
 
 // todo() fix
 //func TestPopulateIndex(t *testing.T) {
-//	nob := getNob(t.TempDir())
+//	nob := getNob(t, t.TempDir())
 //	nob.Set("foo", "24")
 //	nob.Set("bar", "knob")
 //	nob.Set("foo", "42")
@@ -41,7 +41,7 @@ func FuzzGetSet(f *testing.F) {
 	}
 
 	f.Fuzz(func(t *testing.T, key string, val string) {
-		nob := getNob(t.TempDir())
+		nob := getNob(t, t.TempDir())
 
 		nob.Set(key, val)
 		res, _ := nob.Get(key)
@@ -53,14 +53,13 @@ func FuzzGetSet(f *testing.F) {
 }
 
 func TestSetSegmentation(t *testing.T) {
-	// 31 bytes
-	key := "ottffs"
+	// 31 bytes each
 	val := "stkerjfnxkfalgktxadjklxad"
-	nob := getNob(t.TempDir())
+	nob := getNob(t, t.TempDir())
 
 	// act
-	for _ = range 5 {
-		nob.Set(key, val)
+	for i := range 5 {
+		nob.Set(fmt.Sprintf("ottff%v", i), val)
 	}
 
 	// memtable is empty
@@ -69,41 +68,31 @@ func TestSetSegmentation(t *testing.T) {
 		t.Fatalf("size %v should've been 0", s)
 	}
 
-	dirs, err := os.ReadDir(nob.rootDir)
-	if err != nil {
-		t.Fatal(err)
-	}
-	var segCreated bool
-	for _, dir := range dirs {
-		rxp, _ := regexp.Compile("^seg.*")
-		if rxp.MatchString(dir.Name()) {
-			segCreated = true
-		}
-	}
-
-	if !segCreated {
+	// segments are written in the background
+	nob.waitForFlushes()
+	if len(nob.currentVersion().all()) == 0 {
 		t.Fatal("shouldve been a segment file")
 	}
 }
 
 func TestCompact(t *testing.T) {
-	f1, _ := os.Open("test-data/seg_1")
-	f2, _ := os.Open("test-data/seg_2")
 	tdir := t.TempDir()
-	nob := getNob(tdir)
-
-	res, ok := nob.compact(f1, f2)
-	exp := map[string]string{
-		"foo":     "latest",
-		"baz":     "asolatest",
-		"finbean": "82",
-	}
+	nob := getNob(t, tdir)
 
+	merged, ok := nob.compact("test-data/seg_2", "test-data/seg_1")
 	if !ok {
 		t.Fatalf("wanted files in dir")
 	}
+	defer merged.close()
 
-	if !maps.Equal(res, exp) {
+	var res []string
+	for merged.next() {
+		val, _ := unmarkValue(merged.raw())
+		res = append(res, userKeyOf(merged.key())+" "+val)
+	}
+	exp := []string{"baz asolatest", "finbean 82", "foo latest"}
+
+	if !slices.Equal(res, exp) {
 		t.Fatalf("got %v want %v", res, exp)
 	}
 }
@@ -111,49 +100,45 @@ func TestCompact(t *testing.T) {
 func TestMergeCompact(t *testing.T) {
 	tdir := t.TempDir()
 	setupTestFile("test-data", tdir)
-	nob := getNob(tdir)
+	nob := getNob(t, tdir)
 
 	nob.mergeCompact()
 
 	files, _ := os.ReadDir(tdir)
 
-	// expect dir contains compacted_file, compacted_indx
-	var containsCompactedSeg, containsCompactedIndx = false, false
-	var compactedSeg *os.File
-	var compactedIndx *os.File
-	//var compactedIndx *os.File
+	// expect dir contains compacted_file, compacted_bloom
+	var containsCompactedSeg, containsCompactedBloom = false, false
+	var compactedSeg string
 	for _, f := range files {
-		matchedSeg, err := regexp.MatchString("^compacted_\\d+", f.Name())
+		matchedSeg, err := regexp.MatchString("^compacted_\\d+$", f.Name())
 		if err != nil {
 			t.Fatal(err)
 		}
 		if matchedSeg {
 			containsCompactedSeg = true
-			compactedSeg, err = os.Open(path.Join(tdir, f.Name()))
-			if err != nil {
-				t.Fatal(err)
-			}
+			compactedSeg = path.Join(tdir, f.Name())
 		}
-		matchdIndx, err := regexp.MatchString("^indx_compacted_\\d+", f.Name())
-		if matchdIndx {
-			containsCompactedIndx = true
-			compactedIndx, err = os.Open(path.Join(nob.rootDir, f.Name()))
-			if err != nil {
-				log.Fatalln(err)
-			}
+		matchdBloom, err := regexp.MatchString("^bloom_compacted_\\d+$", f.Name())
+		if matchdBloom {
+			containsCompactedBloom = true
 		}
 	}
 
-	if (containsCompactedSeg && containsCompactedIndx) != true {
+	if (containsCompactedSeg && containsCompactedBloom) != true {
 		t.Fatalf("no compacted file")
 	}
 
 	// expect compacted seg is correct
-	rdr, err := io.ReadAll(compactedSeg)
+	table, err := openSSTable(compactedSeg)
 	if err != nil {
-		log.Fatalln(err)
+		t.Fatal(err)
+	}
+	defer table.close()
+	got := map[string]string{}
+	it := table.iterator("")
+	for it.next() {
+		got[userKeyOf(it.key())], _ = unmarkValue(it.raw())
 	}
-	got := convStrToMap(string(rdr))
 	want := map[string]string{
 		"baz":     "asolatest",
 		"finbean": "82",
@@ -163,31 +148,19 @@ func TestMergeCompact(t *testing.T) {
 		t.Fatalf("got %v, want %v", got, want)
 	}
 
-	// expect compacted memtable is correct
-	b, err := io.ReadAll(compactedIndx)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	got = convStrToMap(string(b))
-	for k, v := range got {
-		offst, err := strconv.Atoi(v)
-		if err != nil {
-			t.Fatal(err)
-		}
-		_, err = compactedSeg.Seek(int64(offst), 0)
+	// expect compacted index is correct
+	for _, h := range table.index {
+		block, err := table.readBlock(h)
 		if err != nil {
 			t.Fatal(err)
 		}
-		readUpto := len(k)
-		b := make([]byte, readUpto)
-		_, err = compactedSeg.Read(b)
+		k, _, _, err := decodeRecord(block)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if string(b) != k {
-			t.Fatal(string(b))
+		if k != h.firstKey {
+			t.Fatal(k)
 		}
-
 	}
 
 	// expect f1, f2 to be deleted
@@ -202,12 +175,13 @@ func TestMergeCompact(t *testing.T) {
 	}
 }
 
-func TestGetOrderedFiles(t *testing.T) {
-	inpDir := "test-data"
-	nob := getNob(inpDir)
+func TestLevelZeroIsNewestFirst(t *testing.T) {
+	inpDir := t.TempDir()
+	setupTestFile("test-data", inpDir)
+	nob := getNob(t, inpDir)
 
-	res := nob.getOrderedSegFiles("^seg", true)
-	exp := []string{path.Join(inpDir, "seg_1"), path.Join(inpDir, "seg_2")}
+	res := levelNames(nob.currentVersion())[0]
+	exp := []string{"seg_2", "seg_1"}
 
 	if !slices.Equal(res, exp) {
 		t.Fatalf("got %v want %v", res, exp)
@@ -215,7 +189,7 @@ func TestGetOrderedFiles(t *testing.T) {
 }
 
 func TestOldKeyFromSegment(t *testing.T) {
-	nob := getNob(t.TempDir())
+	nob := getNob(t, t.TempDir())
 	treasureKey := "x"
 	treasureValue := "marksTheSpot"
 
@@ -239,6 +213,170 @@ func TestOldKeyFromSegment(t *testing.T) {
 	}
 }
 
+func TestDelete(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("foo", "bar")
+
+	err := nob.Delete("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = nob.Get("foo")
+	if err != ErrKeyNotFound {
+		t.Fatalf("got %v want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestDeleteShadowsOlderSegment(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	// compactions would merge the segments away
+	nob.compactMu.Lock()
+	defer nob.compactMu.Unlock()
+	_ = nob.Set("x", "marksTheSpot")
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("junk%02d", i), "values")
+	}
+	_ = nob.Delete("x")
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("junk%02d", i+20), "values")
+	}
+
+	nob.waitForFlushes()
+	if len(nob.currentVersion().all()) < 2 {
+		t.Fatal("value & tombstone should be in different segments")
+	}
+	_, err := nob.Get("x")
+	if err != ErrKeyNotFound {
+		t.Fatalf("got %v want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestGetAtReadsOlderVersions(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("x", "first")
+	snap := nob.Snapshot()
+	defer snap.Release()
+	_ = nob.Set("x", "second")
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("junk%02d", i), "values")
+	}
+	nob.mergeCompact()
+
+	if got, err := nob.GetAt("x", snap.Seq()); err != nil || got != "first" {
+		t.Fatalf("got %v %v at seq %v", got, err, snap.Seq())
+	}
+	if got, err := nob.GetAt("x", nob.LastSequence()); err != nil || got != "second" {
+		t.Fatalf("got %v %v at the last seq", got, err)
+	}
+	if got, err := nob.GetAt("x", 0); err != ErrKeyNotFound {
+		t.Fatalf("got %v %v before any write", got, err)
+	}
+}
+
+func TestNewestWinsWhateverTheSegNo(t *testing.T) {
+	tdir := t.TempDir()
+	strategy := NewSizeTieredStrategy()
+	strategy.MinThreshold = 100
+	nob := getNobWithStrategy(t, tdir, strategy)
+	write := func(val string) string {
+		_ = nob.Set("x", val)
+		for i := range 10 {
+			_ = nob.Set(fmt.Sprintf("junk%02d", i), val)
+		}
+		nob.waitForFlushes()
+		// L0 is newest first, the first file holding x is this write's
+		for _, f := range nob.currentVersion().levels[0] {
+			if f.largest == "x" {
+				return f.name
+			}
+		}
+		t.Fatal("x wasn't flushed")
+		return ""
+	}
+	older, newer := write("old"), write("new")
+	_ = nob.Close()
+
+	// without a manifest files are only known by name, give the older one the higher segNo
+	_ = os.Remove(path.Join(tdir, MANIFEST_NAME))
+	for _, name := range []func(string) string{
+		func(s string) string { return s },
+		bloomNameOf,
+	} {
+		_ = os.Rename(path.Join(tdir, name(older)), path.Join(tdir, name("tmp")))
+		_ = os.Rename(path.Join(tdir, name(newer)), path.Join(tdir, name(older)))
+		_ = os.Rename(path.Join(tdir, name("tmp")), path.Join(tdir, name(newer)))
+	}
+
+	restarted := getNobWithStrategy(t, tdir, strategy)
+	if got, err := restarted.Get("x"); err != nil || got != "new" {
+		t.Fatalf("got %v %v", got, err)
+	}
+}
+
+func TestCompactDropsTombstones(t *testing.T) {
+	tdir := t.TempDir()
+	_ = os.WriteFile(path.Join(tdir, "seg_1"), []byte("baz 23\nfoo bar\n"), 0644)
+	_ = os.WriteFile(path.Join(tdir, "seg_2"), []byte("foo\n"), 0644)
+	nob := getNob(t, t.TempDir())
+
+	merged, _ := nob.compact(path.Join(tdir, "seg_2"), path.Join(tdir, "seg_1"))
+	defer merged.close()
+
+	var res []string
+	for merged.next() {
+		res = append(res, userKeyOf(merged.key()))
+	}
+	exp := []string{"baz"}
+
+	if !slices.Equal(res, exp) {
+		t.Fatalf("got %v want %v", res, exp)
+	}
+}
+
+func TestMergeCompactWritesSortedIndex(t *testing.T) {
+	tdir := t.TempDir()
+	// a couple of flushes, too few to compact in the background,
+	// all merged into a single file
+	strategy := testLeveledStrategy()
+	strategy.MaxFileSize = 1 << 20
+	opts := testOptions(strategy)
+	opts.MemtableSize = 2000
+	nob := getNobWithOptions(t, tdir, opts)
+	for i := range 60 {
+		_ = nob.Set(fmt.Sprintf("key%02d", 59-i), fmt.Sprintf("val%02d", i))
+	}
+
+	nob.mergeCompact()
+
+	compacted := nob.currentVersion().all()
+	if len(compacted) != 1 {
+		t.Fatalf("got %v want a single compacted file", compacted)
+	}
+	table, err := openSSTable(path.Join(nob.rootDir, compacted[0].name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	var keys []string
+	it := table.iterator("")
+	for it.next() {
+		keys = append(keys, it.key())
+	}
+	if !slices.IsSorted(keys) {
+		t.Fatalf("compacted file isn't sorted: %v", keys)
+	}
+
+	if len(table.index) < 2 || table.index[0].offset != 0 {
+		t.Fatalf("index should anchor the first key of every block, got %v", len(table.index))
+	}
+	for i := 1; i < len(table.index); i++ {
+		if table.index[i-1].firstKey >= table.index[i].firstKey {
+			t.Fatal("index isn't sorted")
+		}
+	}
+}
+
 func convStrToMap(str string) map[string]string {
 	res := map[string]string{}
 	kvs := strings.Split(strings.Trim(str, "\n"), "\n")
@@ -272,8 +410,41 @@ func copyFile(dst, src string) {
 	}
 }
 
-func getNob(dir string) *Nob {
-	return NewNob(dir)
+// testOptions(strategy) shrinks sizes so a handful of writes exercises flushes & compactions
+func testOptions(strategy CompactionStrategy) Options {
+	opts := DefaultOptions()
+	// a handful of entries, nodes included
+	opts.MemtableSize = 400
+	opts.BlockSize = 10
+	opts.Strategy = strategy
+	return opts
+}
+
+// testLeveledStrategy() is a LeveledStrategy sized for testOptions
+func testLeveledStrategy() *LeveledStrategy {
+	strategy := NewLeveledStrategy()
+	strategy.LevelBaseSize = 1000
+	strategy.MaxFileSize = 1000
+	return strategy
+}
+
+func getNob(t testing.TB, dir string) *Nob {
+	return getNobWithStrategy(t, dir, testLeveledStrategy())
+}
+
+func getNobWithStrategy(t testing.TB, dir string, strategy CompactionStrategy) *Nob {
+	return getNobWithOptions(t, dir, testOptions(strategy))
+}
+
+func getNobWithOptions(t testing.TB, dir string, opts Options) *Nob {
+	nob, err := NewNobWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = nob.Close()
+	})
+	return nob
 }
 
 func setupDbFile(dir string) *os.File {
@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+// Options tune a Nob. Start from DefaultOptions() and override what you need.
+type Options struct {
+	// MemtableSize is the budget in bytes, nodes included, a memtable is frozen & flushed past.
+	// Overwrites only count the change in the value's size.
+	MemtableSize int64
+	// BlockSize is the size in bytes sstable data blocks are cut at, a Get reads one block per segment
+	BlockSize int64
+	// FlushQueueDepth full memtables may wait for the flusher before writes stall
+	FlushQueueDepth int
+	// CompactionInterval is how often the scheduler looks for compactions when no flush woke it
+	CompactionInterval time.Duration
+	// BloomFalsePositiveRate sizes the bloom filters of new segments, within (0, 1)
+	BloomFalsePositiveRate float64
+	Compression            Codec
+	// Strategy picks the compactions, nil for a LeveledStrategy.
+	// It may be shared by several Nobs, each keeps its own compaction state.
+	Strategy CompactionStrategy
+	// NewMemtable creates the memtables, nil for a util.AVLMap.
+	// A util.SkipList takes writes without blocking reads, but can't drop overwritten versions
+	// of a key. Every version counts towards MemtableSize, so a hot key only makes it flush sooner.
+	// A util.TreeMap won't do as Scans walk it unlocked.
+	NewMemtable func() util.OrderedMap
+	// MergeOperator folds the operands of Merge, nil for an Int64AddOperator.
+	// Operands already written are folded by whichever operator is set when they're read.
+	MergeOperator MergeOperator
+}
+
+// DefaultOptions() returns the options used by NewNob
+func DefaultOptions() Options {
+	return Options{
+		MemtableSize:           4 << 20,
+		BlockSize:              4 << 10,
+		FlushQueueDepth:        DEFAULT_FLUSH_QUEUE_DEPTH,
+		CompactionInterval:     time.Minute,
+		BloomFalsePositiveRate: DEFAULT_BLOOM_FP_RATE,
+		Compression:            DEFAULT_COMPRESSION,
+	}
+}
+
+// Validate() reports the first option out of range
+func (o Options) Validate() error {
+	switch {
+	case o.MemtableSize <= 0:
+		return fmt.Errorf("memtable size must be positive, got %v", o.MemtableSize)
+	case o.BlockSize <= 0:
+		return fmt.Errorf("block size must be positive, got %v", o.BlockSize)
+	case o.FlushQueueDepth < 1:
+		return fmt.Errorf("flush queue depth must be at least 1, got %v", o.FlushQueueDepth)
+	case o.CompactionInterval <= 0:
+		return fmt.Errorf("compaction interval must be positive, got %v", o.CompactionInterval)
+	case o.BloomFalsePositiveRate <= 0 || o.BloomFalsePositiveRate >= 1:
+		return fmt.Errorf("bloom false positive rate must be within (0, 1), got %v", o.BloomFalsePositiveRate)
+	case o.Compression != NO_COMPRESSION && o.Compression != FLATE_COMPRESSION:
+		return fmt.Errorf("unknown codec %v", o.Compression)
+	}
+	return nil
+}
+
+// LoadOptions(configFile) reads options from configFile, if not empty, then from NOB_* environment
+// variables, which win over the file. Anything left unset keeps its default.
+//
+// configFile holds the same KEY=value lines as the environment, # starts a comment:
+//
+//	NOB_MEMTABLE_SIZE=4194304
+//	NOB_BLOCK_SIZE=4096
+//	NOB_FLUSH_QUEUE_DEPTH=2
+//	NOB_COMPACTION_INTERVAL=1m
+//	NOB_BLOOM_FP_RATE=0.01
+//	NOB_COMPRESSION=flate|none
+//	NOB_COMPACTION_STRATEGY=leveled|size-tiered
+//	NOB_MEMTABLE=avl|skiplist
+//	NOB_MERGE_OPERATOR=int64-add|string-append
+func LoadOptions(configFile string) (Options, error) {
+	opts := DefaultOptions()
+	if configFile != "" {
+		f, err := os.Open(configFile)
+		if err != nil {
+			return opts, err
+		}
+		defer f.Close()
+
+		sc := bufio.NewScanner(f)
+		for lineNo := 1; sc.Scan(); lineNo++ {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, val, ok := strings.Cut(line, "=")
+			if !ok {
+				return opts, fmt.Errorf("%v:%v: expected KEY=value", configFile, lineNo)
+			}
+			if err := opts.set(strings.TrimSpace(key), strings.TrimSpace(val)); err != nil {
+				return opts, fmt.Errorf("%v:%v: %w", configFile, lineNo, err)
+			}
+		}
+		if sc.Err() != nil {
+			return opts, sc.Err()
+		}
+	}
+
+	for _, kv := range os.Environ() {
+		key, val, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, "NOB_") {
+			continue
+		}
+		if err := opts.set(key, val); err != nil {
+			return opts, err
+		}
+	}
+	return opts, opts.Validate()
+}
+
+var errUnknownOption = errors.New("unknown option")
+
+// set(key, val) parses a single KEY=value option
+func (o *Options) set(key, val string) error {
+	var err error
+	switch key {
+	case "NOB_MEMTABLE_SIZE":
+		o.MemtableSize, err = strconv.ParseInt(val, 10, 64)
+	case "NOB_BLOCK_SIZE":
+		o.BlockSize, err = strconv.ParseInt(val, 10, 64)
+	case "NOB_FLUSH_QUEUE_DEPTH":
+		o.FlushQueueDepth, err = strconv.Atoi(val)
+	case "NOB_COMPACTION_INTERVAL":
+		o.CompactionInterval, err = time.ParseDuration(val)
+	case "NOB_BLOOM_FP_RATE":
+		o.BloomFalsePositiveRate, err = strconv.ParseFloat(val, 64)
+	case "NOB_COMPRESSION":
+		switch val {
+		case "none":
+			o.Compression = NO_COMPRESSION
+		case "flate":
+			o.Compression = FLATE_COMPRESSION
+		default:
+			err = fmt.Errorf("unknown codec %q", val)
+		}
+	case "NOB_COMPACTION_STRATEGY":
+		switch val {
+		case "leveled":
+			o.Strategy = NewLeveledStrategy()
+		case "size-tiered":
+			o.Strategy = NewSizeTieredStrategy()
+		default:
+			err = fmt.Errorf("unknown compaction strategy %q", val)
+		}
+	case "NOB_MEMTABLE":
+		switch val {
+		case "avl":
+			o.NewMemtable = func() util.OrderedMap { return util.NewAVLMap() }
+		case "skiplist":
+			o.NewMemtable = func() util.OrderedMap { return util.NewSkipList() }
+		default:
+			err = fmt.Errorf("unknown memtable %q", val)
+		}
+	case "NOB_MERGE_OPERATOR":
+		switch val {
+		case "int64-add":
+			o.MergeOperator = NewInt64AddOperator()
+		case "string-append":
+			o.MergeOperator = NewStringAppendOperator(DEFAULT_APPEND_DELIMITER)
+		default:
+			err = fmt.Errorf("unknown merge operator %q", val)
+		}
+	default:
+		err = errUnknownOption
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %w", key, err)
+	}
+	return nil
+}
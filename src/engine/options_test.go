@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+func TestDefaultOptionsAreValid(t *testing.T) {
+	if err := DefaultOptions().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateRejectsBadOptions(t *testing.T) {
+	for name, breakIt := range map[string]func(o *Options){
+		"memtable size": func(o *Options) { o.MemtableSize = 0 },
+		"block size":    func(o *Options) { o.BlockSize = -1 },
+		"queue depth":   func(o *Options) { o.FlushQueueDepth = 0 },
+		"interval":      func(o *Options) { o.CompactionInterval = 0 },
+		"bloom rate":    func(o *Options) { o.BloomFalsePositiveRate = 1 },
+		"codec":         func(o *Options) { o.Compression = 9 },
+	} {
+		opts := DefaultOptions()
+		breakIt(&opts)
+		if opts.Validate() == nil {
+			t.Errorf("%v: wanted an error", name)
+		}
+	}
+}
+
+func TestOpeningWithBadOptionsFails(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemtableSize = 0
+	if nob, err := NewNobWithOptions(t.TempDir(), opts); err == nil {
+		_ = nob.Close()
+		t.Fatal("wanted an error")
+	}
+}
+
+func TestLoadOptionsFromFileAndEnv(t *testing.T) {
+	configFile := path.Join(t.TempDir(), "nob.conf")
+	config := `# test sizes
+NOB_MEMTABLE_SIZE=150
+NOB_BLOCK_SIZE = 10
+NOB_COMPACTION_INTERVAL=5s
+NOB_COMPRESSION=none
+NOB_COMPACTION_STRATEGY=size-tiered
+NOB_MERGE_OPERATOR=string-append
+`
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the environment wins over the file
+	t.Setenv("NOB_BLOCK_SIZE", "64")
+
+	opts, err := LoadOptions(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MemtableSize != 150 || opts.BlockSize != 64 || opts.CompactionInterval != 5*time.Second {
+		t.Fatalf("got %+v", opts)
+	}
+	if opts.Compression != NO_COMPRESSION {
+		t.Fatalf("got codec %v", opts.Compression)
+	}
+	if _, ok := opts.Strategy.(*SizeTieredStrategy); !ok {
+		t.Fatalf("got strategy %T", opts.Strategy)
+	}
+	if _, ok := opts.MergeOperator.(*StringAppendOperator); !ok {
+		t.Fatalf("got merge operator %T", opts.MergeOperator)
+	}
+	// untouched options keep their defaults
+	if opts.FlushQueueDepth != DEFAULT_FLUSH_QUEUE_DEPTH {
+		t.Fatalf("got depth %v", opts.FlushQueueDepth)
+	}
+}
+
+func TestLoadOptionsRejectsBadValues(t *testing.T) {
+	for _, env := range [][2]string{
+		{"NOB_MEMTABLE_SIZE", "lots"},
+		{"NOB_FLUSH_QUEUE_DEPTH", "0"},
+		{"NOB_COMPRESSION", "zstd"},
+		{"NOB_MEMTABLE", "btree"},
+		{"NOB_MERGE_OPERATOR", "max"},
+		{"NOB_MEMTABEL_SIZE", "150"},
+	} {
+		t.Run(env[0], func(t *testing.T) {
+			t.Setenv(env[0], env[1])
+			if _, err := LoadOptions(""); err == nil {
+				t.Fatalf("%v=%v should fail", env[0], env[1])
+			}
+		})
+	}
+}
+
+func TestMemtableSizeOption(t *testing.T) {
+	opts := testOptions(testLeveledStrategy())
+	opts.MemtableSize = 1000
+	nob := getNobWithOptions(t, t.TempDir(), opts)
+	for i := range 10 {
+		_ = nob.Set(fmt.Sprintf("key%02d", i), "val")
+	}
+	nob.waitForFlushes()
+	if n := len(nob.currentVersion().all()); n != 0 {
+		t.Fatalf("flushed %v segments below the memtable size", n)
+	}
+}
+
+func TestSkipListMemtableOption(t *testing.T) {
+	t.Setenv("NOB_MEMTABLE", "skiplist")
+	loaded, err := LoadOptions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions(testLeveledStrategy())
+	opts.NewMemtable = loaded.NewMemtable
+	nob := getNobWithOptions(t, t.TempDir(), opts)
+	if _, ok := nob.memtable.(*util.SkipList); !ok {
+		t.Fatalf("got memtable %T", nob.memtable)
+	}
+
+	for i := range 50 {
+		_ = nob.Set(fmt.Sprintf("key%02d", i), fmt.Sprint(i))
+	}
+	_ = nob.Delete("key07")
+	for i := range 50 {
+		got, err := nob.Get(fmt.Sprintf("key%02d", i))
+		if i == 7 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("got %v %v for a deleted key", got, err)
+			}
+			continue
+		}
+		if err != nil || got != fmt.Sprint(i) {
+			t.Fatalf("key%02d got %v %v", i, got, err)
+		}
+	}
+	it := nob.Scan("key10", "key20")
+	defer it.Close()
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != 10 {
+		t.Fatalf("scanned %v keys", n)
+	}
+}
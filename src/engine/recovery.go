@@ -0,0 +1,190 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const TMP_SUFFIX = ".tmp"
+const QUARANTINE_DIR = "quarantine"
+
+var dataFileRxp = regexp.MustCompile(`^(seg|compacted)_(\d+)$`)
+
+// recoveryReport describes what recover() found in rootDir
+type recoveryReport struct {
+	live        []string
+	quarantined []string
+	maxSegNo    int
+}
+
+// recover() rebuilds segment numbering from the files already in rootDir.
+// Half-written (.tmp) files and data / index files missing their partner are moved
+// into rootDir/quarantine so they're never read, but are kept around for inspection.
+//
+// Segments are written to .tmp and renamed once complete (see commitSegment), so a
+// text segment without its index, or an sstable without its footer, was never
+// acknowledged as flushed.
+func (nob *Nob) recover() (recoveryReport, error) {
+	report := recoveryReport{}
+	dirFiles, err := os.ReadDir(nob.rootDir)
+	if err != nil {
+		return report, err
+	}
+
+	names := map[string]bool{}
+	for _, f := range dirFiles {
+		if !f.IsDir() {
+			names[f.Name()] = true
+		}
+	}
+
+	for name := range names {
+		var orphaned bool
+		switch {
+		case strings.HasSuffix(name, TMP_SUFFIX):
+			orphaned = true
+		case dataFileRxp.MatchString(name):
+			segNo, _ := strconv.Atoi(dataFileRxp.FindStringSubmatch(name)[2])
+			report.maxSegNo = max(report.maxSegNo, segNo)
+			if !names[indexNameOf(name)] && !isSSTable(path.Join(nob.rootDir, name)) {
+				orphaned = true
+			} else {
+				report.live = append(report.live, name)
+			}
+		case frozenWalRxp.MatchString(name):
+			// its memtable is flushed to that segment number
+			report.maxSegNo = max(report.maxSegNo, segNoOf(frozenWalRxp.FindStringSubmatch(name)[1]))
+		case strings.HasPrefix(name, "indx_"):
+			orphaned = !names[strings.TrimPrefix(name, "indx_")]
+		case strings.HasPrefix(name, "bloom_"):
+			orphaned = !names[strings.TrimPrefix(name, "bloom_")]
+		}
+
+		if orphaned {
+			if err := nob.quarantine(name); err != nil {
+				return report, err
+			}
+			report.quarantined = append(report.quarantined, name)
+		}
+	}
+
+	sort.Strings(report.live)
+	nob.segNo = report.maxSegNo
+
+	v, ok, err := loadManifest(nob.rootDir)
+	if err != nil {
+		return report, err
+	}
+	if !ok {
+		v, err = nob.buildVersion(report.live)
+	} else {
+		v, report, err = nob.reconcileManifest(v, report, names)
+	}
+	if err != nil {
+		return report, err
+	}
+	for _, f := range v.all() {
+		if f.bloom, err = nob.loadBloom(f.name); err != nil {
+			return report, err
+		}
+	}
+	// startup compacts the manifest to a snapshot
+	if err := nob.writeManifestSnapshot(v); err != nil {
+		return report, err
+	}
+	v.ref()
+	nob.version = v
+
+	return report, nil
+}
+
+// reconcileManifest(v, report, names) treats the manifest as the source of truth.
+// Data files it doesn't know about are leftovers of a flush or compaction that never
+// finished, and are quarantined.
+func (nob *Nob) reconcileManifest(v *version, report recoveryReport, names map[string]bool) (*version, recoveryReport, error) {
+	live := map[string]bool{}
+	for _, name := range report.live {
+		live[name] = true
+	}
+	inManifest := map[string]bool{}
+	for _, f := range v.all() {
+		if !live[f.name] {
+			return nil, report, fmt.Errorf("manifest references missing segment %v", f.name)
+		}
+		inManifest[f.name] = true
+	}
+
+	var kept []string
+	for _, name := range report.live {
+		if inManifest[name] {
+			kept = append(kept, name)
+			continue
+		}
+		if err := nob.quarantine(name); err != nil {
+			return nil, report, err
+		}
+		report.quarantined = append(report.quarantined, name)
+		// text segments have an index, older ones no bloom filter
+		for _, sidecar := range []string{indexNameOf(name), bloomNameOf(name)} {
+			if names[sidecar] {
+				if err := nob.quarantine(sidecar); err != nil {
+					return nil, report, err
+				}
+				report.quarantined = append(report.quarantined, sidecar)
+			}
+		}
+	}
+	report.live = kept
+	return v, report, nil
+}
+
+// quarantine(name) moves name out of rootDir so it no longer takes part in reads or compaction
+func (nob *Nob) quarantine(name string) error {
+	qdir := path.Join(nob.rootDir, QUARANTINE_DIR)
+	err := os.MkdirAll(qdir, 0755)
+	if err != nil {
+		return err
+	}
+	log.Println("quarantining", name)
+	return os.Rename(path.Join(nob.rootDir, name), path.Join(qdir, name))
+}
+
+func indexNameOf(segName string) string {
+	return fmt.Sprintf("indx_%v", segName)
+}
+
+// commitSegment(segName) atomically publishes a segment written to {segName}.tmp.
+// The bloom filter is renamed first, so a crash in between leaves an orphaned
+// sidecar, never a segment without its filter.
+func (nob *Nob) commitSegment(segName string) {
+	bloomPath := path.Join(nob.rootDir, bloomNameOf(segName))
+	err := os.Rename(bloomPath+TMP_SUFFIX, bloomPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	segPath := path.Join(nob.rootDir, segName)
+	err = os.Rename(segPath+TMP_SUFFIX, segPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	syncDir(nob.rootDir)
+}
+
+// syncDir(dir) makes renames and creates within dir durable
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+func TestRecoverSegNo(t *testing.T) {
+	tdir := t.TempDir()
+	setupTestFile("test-data", tdir)
+
+	nob := getNob(t, tdir)
+
+	if nob.segNo != 2 {
+		t.Fatalf("got segNo %v want %v", nob.segNo, 2)
+	}
+	if nob.allocateSeg() != 3 {
+		t.Fatal("restart should never reuse a segment number")
+	}
+}
+
+func TestRecoverKeepsDataAcrossRestarts(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	for _ = range 5 {
+		_ = nob.Set("first", "stkerjfnxkfalgktxadjklxad")
+	}
+
+	_ = nob.Close()
+	restarted := getNob(t, tdir)
+	for _ = range 5 {
+		_ = restarted.Set("second", "stkerjfnxkfalgktxadjklxad")
+	}
+
+	got, err := restarted.Get("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "stkerjfnxkfalgktxadjklxad" {
+		t.Fatalf("got %v want %v", got, "stkerjfnxkfalgktxadjklxad")
+	}
+}
+
+func TestRecoverQuarantinesOrphans(t *testing.T) {
+	tdir := t.TempDir()
+	setupTestFile("test-data", tdir)
+	// half-written flush
+	_ = os.WriteFile(path.Join(tdir, "seg_3.tmp"), []byte("foo ba"), 0644)
+	// segment whose index never made it
+	_ = os.WriteFile(path.Join(tdir, "seg_4"), []byte("foo bar\n"), 0644)
+	// index whose segment is gone
+	_ = os.WriteFile(path.Join(tdir, "indx_seg_5"), []byte(""), 0644)
+
+	nob := getNob(t, tdir)
+
+	segFiles := levelNames(nob.currentVersion())[0]
+	exp := []string{"seg_2", "seg_1"}
+	if !slices.Equal(segFiles, exp) {
+		t.Fatalf("got %v want %v", segFiles, exp)
+	}
+
+	quarantined, err := os.ReadDir(path.Join(tdir, QUARANTINE_DIR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range quarantined {
+		got = append(got, f.Name())
+	}
+	want := []string{"indx_seg_5", "seg_3.tmp", "seg_4"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestOpenReturnsRecoveryErrors(t *testing.T) {
+	notADir := path.Join(t.TempDir(), "file")
+	_ = os.WriteFile(notADir, nil, 0644)
+	if _, err := NewNobWithOptions(notADir, testOptions(testLeveledStrategy())); err == nil {
+		t.Fatal("opening a file as the root dir should've failed")
+	}
+
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	_ = nob.Set("foo", "bar")
+	nob.writeMu.Lock()
+	nob.freezeMemtable()
+	nob.writeMu.Unlock()
+	nob.mergeCompact()
+	_ = nob.Close()
+	if len(nob.currentVersion().all()) == 0 {
+		t.Fatal("foo should've been flushed")
+	}
+	for _, f := range nob.currentVersion().all() {
+		_ = os.Remove(path.Join(tdir, f.name))
+	}
+	if _, err := NewNobWithOptions(tdir, testOptions(testLeveledStrategy())); err == nil {
+		t.Fatal("a manifest naming a missing segment should've failed the open")
+	}
+}
@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"time"
+)
+
+// startScheduler(interval) runs compactions picked by the strategy in the background.
+// It wakes up after every flush, and every interval in case a wake up was missed.
+func (nob *Nob) startScheduler(interval time.Duration) {
+	nob.wake = make(chan struct{}, 1)
+	nob.stop = make(chan struct{})
+	nob.stopped = make(chan struct{})
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer close(nob.stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-nob.stop:
+				return
+			case <-ticker.C:
+			case <-nob.wake:
+			}
+			nob.runPendingCompactions()
+		}
+	}()
+}
+
+// scheduleCompaction() wakes the scheduler without waiting for it
+func (nob *Nob) scheduleCompaction() {
+	select {
+	case nob.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runPendingCompactions() runs compactions until the strategy has nothing left to pick,
+// or one fails, which is retried the next time the scheduler wakes.
+// Reads and writes carry on while a compaction runs, they only wait for it to publish its version.
+func (nob *Nob) runPendingCompactions() {
+	for {
+		nob.compactMu.Lock()
+		c := nob.pickCompaction(false)
+		ok := c != nil && nob.runCompaction(c)
+		nob.compactMu.Unlock()
+
+		if !ok {
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"slices"
+	"sort"
+)
+
+// Snapshot is a read-only view of the database as it was when taken. Writes, flushes
+// and compactions carry on underneath it: every write has a sequence number, a snapshot
+// reads the newest version of a key written at or before its own, and the versions
+// a live snapshot may read are kept until it is released.
+type Snapshot struct {
+	nob      *Nob
+	seq      uint64
+	released bool
+}
+
+// Snapshot() returns a view of every write acknowledged so far. It must be released,
+// until then compactions can't drop the versions it sees.
+func (nob *Nob) Snapshot() *Snapshot {
+	nob.mu.Lock()
+	defer nob.mu.Unlock()
+	s := &Snapshot{nob: nob, seq: nob.lastSeq.Load()}
+	i, _ := slices.BinarySearch(nob.snapshots, s.seq)
+	nob.snapshots = slices.Insert(nob.snapshots, i, s.seq)
+	return s
+}
+
+// Seq() numbers the latest write s sees, reads at it with Nob.GetAt are reliable until s
+// is released
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Get(key) returns the value key had when s was taken
+func (s *Snapshot) Get(key string) (string, error) {
+	return s.nob.get(key, s.seq)
+}
+
+// Scan(start, end) iterates over every key live in [start, end) when s was taken.
+// An empty end means no upper bound.
+func (s *Snapshot) Scan(start, end string) *Iterator {
+	return s.nob.scan(start, end, s.seq)
+}
+
+// Release() lets compactions drop the versions only s could see. Releasing twice is a no-op.
+func (s *Snapshot) Release() {
+	nob := s.nob
+	nob.mu.Lock()
+	defer nob.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	i, _ := slices.BinarySearch(nob.snapshots, s.seq)
+	nob.snapshots = slices.Delete(nob.snapshots, i, i+1)
+}
+
+// liveSnapshots() returns the sequence numbers of the unreleased snapshots, ascending
+func (nob *Nob) liveSnapshots() []uint64 {
+	nob.mu.RLock()
+	defer nob.mu.RUnlock()
+	return slices.Clone(nob.snapshots)
+}
+
+// stripeOf(snapshots, seq) returns the stripe of seq: the versions of a key written
+// between two snapshots (ascending) are in the same stripe, and only the newest of
+// them is visible to any snapshot or to reads of the latest version.
+func stripeOf(snapshots []uint64, seq uint64) int {
+	return sort.Search(len(snapshots), func(i int) bool {
+		return snapshots[i] >= seq
+	})
+}
@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+func TestSnapshotIgnoresLaterWrites(t *testing.T) {
+	memtables := map[string]func() util.OrderedMap{
+		"avl":      func() util.OrderedMap { return util.NewAVLMap() },
+		"skiplist": func() util.OrderedMap { return util.NewSkipList() },
+	}
+	for name, newMemtable := range memtables {
+		t.Run(name, func(t *testing.T) {
+			opts := testOptions(testLeveledStrategy())
+			opts.NewMemtable = newMemtable
+			nob := getNobWithOptions(t, t.TempDir(), opts)
+			_ = nob.Set("a", "1")
+			_ = nob.Set("b", "1")
+
+			snap := nob.Snapshot()
+			defer snap.Release()
+			_ = nob.Set("a", "2")
+			_ = nob.Delete("b")
+			_ = nob.Set("c", "2")
+
+			for k, want := range map[string]string{"a": "1", "b": "1"} {
+				if got, err := snap.Get(k); err != nil || got != want {
+					t.Fatalf("snapshot %v got %v %v want %v", k, got, err, want)
+				}
+			}
+			if got, err := snap.Get("c"); err != ErrKeyNotFound {
+				t.Fatalf("snapshot sees c written after it: %v %v", got, err)
+			}
+			if got := collect(snap.Scan("", "")); fmt.Sprint(got) != "map[a:1 b:1]" {
+				t.Fatalf("snapshot scanned %v", got)
+			}
+
+			if got, _ := nob.Get("a"); got != "2" {
+				t.Fatalf("latest a got %v", got)
+			}
+			if got := collect(nob.Scan("", "")); fmt.Sprint(got) != "map[a:2 c:2]" {
+				t.Fatalf("scanned %v", got)
+			}
+		})
+	}
+}
+
+func TestSnapshotSurvivesFlushesAndCompaction(t *testing.T) {
+	// a full size-tiered compaction rewrites everything into a single file
+	nob := getNobWithStrategy(t, t.TempDir(), NewSizeTieredStrategy())
+	for i := range 30 {
+		_ = nob.Set(fmt.Sprintf("key%02d", i), "old")
+	}
+	snap := nob.Snapshot()
+	for i := range 30 {
+		if i%3 == 0 {
+			_ = nob.Delete(fmt.Sprintf("key%02d", i))
+			continue
+		}
+		_ = nob.Set(fmt.Sprintf("key%02d", i), "new")
+	}
+	nob.mergeCompact()
+
+	for i := range 30 {
+		key := fmt.Sprintf("key%02d", i)
+		if got, err := snap.Get(key); err != nil || got != "old" {
+			t.Fatalf("snapshot %v got %v %v", key, got, err)
+		}
+		got, err := nob.Get(key)
+		if i%3 == 0 && err != ErrKeyNotFound {
+			t.Fatalf("deleted %v got %v %v", key, got, err)
+		}
+		if i%3 != 0 && got != "new" {
+			t.Fatalf("%v got %v %v", key, got, err)
+		}
+	}
+	if got := collect(snap.Scan("", "")); len(got) != 30 {
+		t.Fatalf("snapshot scanned %v keys", len(got))
+	}
+
+	// released, the old versions can go
+	snap.Release()
+	nob.mergeCompact()
+	records := 0
+	for _, f := range nob.currentVersion().all() {
+		table, err := openSSTable(path.Join(nob.rootDir, f.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		it := table.iterator("")
+		for it.next() {
+			records++
+		}
+		it.close()
+	}
+	if records != 20 {
+		t.Fatalf("got %v records after release, want 20", records)
+	}
+}
+
+func TestSnapshotScanIsConsistentWhileWriting(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	write := func(gen int) {
+		b := NewWriteBatch()
+		for i := range 10 {
+			b.Set(fmt.Sprintf("key%v", i), fmt.Sprint(gen))
+		}
+		if err := nob.Write(b); err != nil {
+			t.Error(err)
+		}
+	}
+	write(0)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for gen := 1; ; gen++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			write(gen)
+			if gen%20 == 0 {
+				nob.mergeCompact()
+			}
+		}
+	}()
+
+	for range 50 {
+		snap := nob.Snapshot()
+		first := collect(snap.Scan("", ""))
+		for k, v := range first {
+			if v != first["key0"] {
+				t.Fatalf("snapshot saw %v=%v and key0=%v", k, v, first["key0"])
+			}
+			if got, _ := snap.Get(k); got != v {
+				t.Fatalf("snapshot get %v got %v, scanned %v", k, got, v)
+			}
+		}
+		if len(first) != 10 {
+			t.Fatalf("snapshot scanned %v", first)
+		}
+		snap.Release()
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestSequenceNumbersSurviveRestart(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("key%02d", i), "val")
+	}
+	nob.waitForFlushes()
+	last := nob.LastSequence()
+	_ = nob.Close()
+
+	// the wal only holds the unflushed writes, the manifest must remember the rest
+	restarted := getNob(t, tdir)
+	if got := restarted.LastSequence(); got != last {
+		t.Fatalf("restarted at seq %v want %v", got, last)
+	}
+	_ = restarted.Set("key00", "newer")
+	if got, _ := restarted.Get("key00"); got != "newer" {
+		t.Fatalf("got %v", got)
+	}
+}
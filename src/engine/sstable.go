@@ -0,0 +1,394 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path"
+	"sort"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+// SSTable layout:
+//
+//	| data block 0 | ... | data block n | index block | footer |
+//
+// data block: the codec the records are compressed with, the (compressed) records, then a crc32
+// of both. Keys are internal keys (see makeInternalKey), a marked value may be an expiring one
+// (see markExpiring) or a merge operand (see Nob.Merge).
+//
+//	| codec (1) | records | crc (4) |
+//	record: | key len (uvarint) | key | value len (uvarint) | marked value |
+//
+// index block: an entry per data block followed by a crc32 of them
+//
+//	entry: | first key len (uvarint) | first key | offset (uvarint) | size (uvarint) |
+//
+// footer: | index offset (8) | index size (8) | version (4) | magic (4) |
+const SSTABLE_MAGIC = 0x53424f4e // "NOBS"
+const SSTABLE_VERSION = 5
+const FOOTER_SIZE = 24
+
+var errNotSSTable = errors.New("not an sstable")
+var errCorruptBlock = errors.New("corrupt sstable block")
+
+// blockHandle locates a data block, size includes its crc
+type blockHandle struct {
+	firstKey string
+	offset   int64
+	size     int64
+}
+
+// tableWriter streams sorted records into blocks of about blockSize bytes
+type tableWriter struct {
+	writer    *bufio.Writer
+	blockSize int64
+	codec     Codec
+	encoder   *blockEncoder
+	offset    int64
+	block     []byte
+	firstKey  string
+	index     []blockHandle
+}
+
+func newTableWriter(f *os.File, blockSize int64, codec Codec) *tableWriter {
+	return &tableWriter{writer: bufio.NewWriter(f), blockSize: blockSize, codec: codec, encoder: &blockEncoder{}}
+}
+
+func (tw *tableWriter) add(key, raw string) {
+	if len(tw.block) == 0 {
+		tw.firstKey = key
+	}
+	tw.block = binary.AppendUvarint(tw.block, uint64(len(key)))
+	tw.block = append(tw.block, key...)
+	tw.block = binary.AppendUvarint(tw.block, uint64(len(raw)))
+	tw.block = append(tw.block, raw...)
+
+	if int64(len(tw.block)) >= tw.blockSize {
+		tw.flushBlock()
+	}
+}
+
+func (tw *tableWriter) flushBlock() {
+	if len(tw.block) == 0 {
+		return
+	}
+	size := tw.writeChecksummed(tw.encoder.encode(tw.codec, tw.block))
+	tw.index = append(tw.index, blockHandle{firstKey: tw.firstKey, offset: tw.offset, size: size})
+	tw.offset += size
+	tw.block = tw.block[:0]
+}
+
+// writeChecksummed(payload) writes payload and its crc, returning the bytes written
+func (tw *tableWriter) writeChecksummed(payload []byte) int64 {
+	payload = binary.LittleEndian.AppendUint32(payload, crc32.ChecksumIEEE(payload))
+	_, err := tw.writer.Write(payload)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return int64(len(payload))
+}
+
+// finish() writes the index block & footer
+func (tw *tableWriter) finish() {
+	tw.flushBlock()
+
+	var indexBlock []byte
+	for _, h := range tw.index {
+		indexBlock = binary.AppendUvarint(indexBlock, uint64(len(h.firstKey)))
+		indexBlock = append(indexBlock, h.firstKey...)
+		indexBlock = binary.AppendUvarint(indexBlock, uint64(h.offset))
+		indexBlock = binary.AppendUvarint(indexBlock, uint64(h.size))
+	}
+	indexOffset := tw.offset
+	indexSize := tw.writeChecksummed(indexBlock)
+
+	footer := binary.LittleEndian.AppendUint64(nil, uint64(indexOffset))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(indexSize))
+	footer = binary.LittleEndian.AppendUint32(footer, SSTABLE_VERSION)
+	footer = binary.LittleEndian.AppendUint32(footer, SSTABLE_MAGIC)
+	_, err := tw.writer.Write(footer)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = tw.writer.Flush()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	tw.offset += indexSize + FOOTER_SIZE
+}
+
+// writeTable(segFile, records, maxSize) writes the sorted records to segFile as an sstable,
+// stopping once it holds maxSize bytes (0 for no limit), and a bloom_{segFile} filter of its keys.
+// The versions of a key are never split across tables, so files below L0 don't overlap.
+//
+// It returns the size, user key & sequence number ranges written, or nil if records was empty
+func (nob *Nob) writeTable(segFile *os.File, records *versionFilter, maxSize int64) *fileMeta {
+	opts := nob.opts
+	var meta *fileMeta
+	var hashes []uint64
+	tw := newTableWriter(segFile, opts.BlockSize, opts.Compression)
+	for records.next() {
+		key := userKeyOf(records.key())
+		if meta != nil && maxSize != 0 && tw.offset+int64(len(tw.block)) >= maxSize && key != meta.largest {
+			records.pushBack()
+			break
+		}
+		seq := seqOf(records.key())
+		if meta == nil {
+			meta = &fileMeta{smallest: key, smallestSeq: seq}
+		}
+		meta.largest = key
+		meta.smallestSeq = min(meta.smallestSeq, seq)
+		meta.largestSeq = max(meta.largestSeq, seq)
+		hashes = append(hashes, util.BloomHash(key))
+		tw.add(records.key(), records.raw())
+	}
+	tw.finish()
+
+	bloomPath := path.Join(path.Dir(segFile.Name()), bloomNameOf(path.Base(segFile.Name())))
+	bloom := writeBloomFile(bloomPath, hashes, opts.BloomFalsePositiveRate)
+
+	if meta != nil {
+		meta.size = tw.offset
+		meta.bloom = bloom
+	}
+	return meta
+}
+
+// sstable reads an sstable file, holding its index in memory
+type sstable struct {
+	file  *os.File
+	index []blockHandle
+}
+
+// openSSTable(p) returns errNotSSTable for files without a valid footer, such as
+// segments written in the older text format
+func openSSTable(p string) (*sstable, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	t := &sstable{file: f}
+	if err := t.readIndex(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// isSSTable(p) reports whether p ends in an sstable footer
+func isSSTable(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	_, _, err = readFooter(f)
+	return err == nil
+}
+
+// readFooter(f) returns the index offset & index size of f
+func readFooter(f *os.File) (int64, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if info.Size() < FOOTER_SIZE {
+		return 0, 0, errNotSSTable
+	}
+	footer := make([]byte, FOOTER_SIZE)
+	if _, err := f.ReadAt(footer, info.Size()-FOOTER_SIZE); err != nil {
+		return 0, 0, err
+	}
+	if binary.LittleEndian.Uint32(footer[20:24]) != SSTABLE_MAGIC {
+		return 0, 0, errNotSSTable
+	}
+	if binary.LittleEndian.Uint32(footer[16:20]) != SSTABLE_VERSION {
+		return 0, 0, errors.New("unsupported sstable version")
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	indexSize := int64(binary.LittleEndian.Uint64(footer[8:16]))
+	if indexOffset < 0 || indexSize < 4 || indexOffset+indexSize != info.Size()-FOOTER_SIZE {
+		return 0, 0, errCorruptBlock
+	}
+	return indexOffset, indexSize, nil
+}
+
+func (t *sstable) readIndex() error {
+	indexOffset, indexSize, err := readFooter(t.file)
+	if err != nil {
+		return err
+	}
+	payload, err := t.readChecksummed(indexOffset, indexSize)
+	if err != nil {
+		return err
+	}
+
+	for len(payload) > 0 {
+		var h blockHandle
+		var ok bool
+		if h.firstKey, payload, ok = readUvarintBytes(payload); !ok {
+			return errCorruptBlock
+		}
+		offset, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return errCorruptBlock
+		}
+		payload = payload[n:]
+		size, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return errCorruptBlock
+		}
+		payload = payload[n:]
+		h.offset, h.size = int64(offset), int64(size)
+		t.index = append(t.index, h)
+	}
+	return nil
+}
+
+// readChecksummed(offset, size) reads a block and verifies its crc
+func (t *sstable) readChecksummed(offset, size int64) ([]byte, error) {
+	if size < 4 {
+		return nil, errCorruptBlock
+	}
+	buf := make([]byte, size)
+	if _, err := t.file.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	payload := buf[:size-4]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(buf[size-4:]) {
+		return nil, errCorruptBlock
+	}
+	return payload, nil
+}
+
+// readBlock(h) reads and decompresses the data block h points at
+func (t *sstable) readBlock(h blockHandle) ([]byte, error) {
+	payload, err := t.readChecksummed(h.offset, h.size)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(payload)
+}
+
+// readUvarintBytes(b) splits a length prefixed string off the front of b
+func readUvarintBytes(b []byte) (string, []byte, bool) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return "", nil, false
+	}
+	return string(b[n : n+int(l)]), b[n+int(l):], true
+}
+
+// seekBlock(key) returns the index of the last block whose first (internal) key is <= key
+func (t *sstable) seekBlock(key string) int {
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].firstKey > key
+	})
+	return max(i-1, 0)
+}
+
+// get(key, seq) returns the marked value & sequence number of the newest version of key
+// written at or before seq. That's the first record from (key, seq) on, which usually
+// is in the block seekBlock picks but may start the next one.
+func (t *sstable) get(key string, seq uint64) (string, uint64, bool, error) {
+	target := makeInternalKey(key, seq)
+	for blockNo := t.seekBlock(target); blockNo < len(t.index); blockNo++ {
+		block, err := t.readBlock(t.index[blockNo])
+		if err != nil {
+			return "", 0, false, err
+		}
+
+		for len(block) > 0 {
+			var k, raw string
+			k, raw, block, err = decodeRecord(block)
+			if err != nil {
+				return "", 0, false, err
+			}
+			if k < target {
+				continue
+			}
+			if userKeyOf(k) != key {
+				return "", 0, false, nil
+			}
+			return raw, seqOf(k), true, nil
+		}
+	}
+	return "", 0, false, nil
+}
+
+// decodeRecord(block) splits the first record off block
+func decodeRecord(block []byte) (string, string, []byte, error) {
+	k, block, ok := readUvarintBytes(block)
+	if !ok {
+		return "", "", nil, errCorruptBlock
+	}
+	raw, block, ok := readUvarintBytes(block)
+	if !ok || len(raw) == 0 {
+		return "", "", nil, errCorruptBlock
+	}
+	return k, raw, block, nil
+}
+
+func (t *sstable) close() {
+	_ = t.file.Close()
+}
+
+// sstableIterator walks records block by block
+type sstableIterator struct {
+	table   *sstable
+	blockNo int
+	block   []byte
+	k       string
+	r       string
+	e       error
+}
+
+// iterator(start) begins at the block that would contain the newest version of user key start
+func (t *sstable) iterator(start string) *sstableIterator {
+	return &sstableIterator{table: t, blockNo: t.seekBlock(makeInternalKey(start, MAX_SEQUENCE)) - 1}
+}
+
+func (it *sstableIterator) next() bool {
+	var err error
+	for len(it.block) == 0 {
+		if it.blockNo+1 >= len(it.table.index) {
+			return false
+		}
+		it.blockNo++
+		it.block, err = it.table.readBlock(it.table.index[it.blockNo])
+		if err != nil {
+			it.e = fmt.Errorf("%v: %w", it.table.file.Name(), err)
+			return false
+		}
+	}
+
+	it.k, it.r, it.block, err = decodeRecord(it.block)
+	if err != nil {
+		it.e = fmt.Errorf("%v: %w", it.table.file.Name(), err)
+		return false
+	}
+	return true
+}
+
+func (it *sstableIterator) key() string {
+	return it.k
+}
+
+func (it *sstableIterator) raw() string {
+	return it.r
+}
+
+func (it *sstableIterator) err() error {
+	return it.e
+}
+
+func (it *sstableIterator) close() {
+	it.table.close()
+}
@@ -0,0 +1,165 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSSTableHoldsSpacesAndNewlines(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	want := map[string]string{}
+	for i := range 30 {
+		key := fmt.Sprintf("doc %02d", i)
+		want[key] = fmt.Sprintf("{\n  \"id\": %v,\n  \"name\": \"a b c\"\n}", i)
+		_ = nob.Set(key, want[key])
+	}
+	_ = nob.Close()
+
+	// drop the memtable so every read goes through a segment
+	nob = getNob(t, tdir)
+	nob.mergeCompact()
+	for key, val := range want {
+		got, err := nob.Get(key)
+		if err != nil || got != val {
+			t.Fatalf("key %q got %q %v want %q", key, got, err, val)
+		}
+	}
+
+	it := nob.Scan("", "")
+	defer it.Close()
+	n := 0
+	for it.Next() {
+		if want[it.Key()] != it.Value() {
+			t.Fatalf("key %q got %q", it.Key(), it.Value())
+		}
+		n++
+	}
+	if n != len(want) {
+		t.Fatalf("scanned %v keys want %v", n, len(want))
+	}
+}
+
+func TestTextSegmentsStayReadable(t *testing.T) {
+	tdir := t.TempDir()
+	setupTestFile("test-data", tdir)
+	nob := getNob(t, tdir)
+
+	want := map[string]string{"baz": "asolatest", "finbean": "82", "foo": "latest"}
+	for key, val := range want {
+		got, err := nob.Get(key)
+		if err != nil || got != val {
+			t.Fatalf("key %v got %v %v want %v", key, got, err, val)
+		}
+	}
+
+	// compaction migrates them to sstables
+	nob.mergeCompact()
+	for _, f := range nob.currentVersion().all() {
+		if !isSSTable(path.Join(tdir, f.name)) {
+			t.Fatalf("%v wasn't rewritten as an sstable", f.name)
+		}
+	}
+	for key, val := range want {
+		got, err := nob.Get(key)
+		if err != nil || got != val {
+			t.Fatalf("key %v got %v %v want %v", key, got, err, val)
+		}
+	}
+}
+
+func TestSSTableDetectsCorruptBlock(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("key%02d", i), "val")
+	}
+
+	nob.waitForFlushes()
+	seg := nob.currentVersion().levels[0][0]
+	segPath := path.Join(tdir, seg.name)
+	b, err := os.ReadFile(segPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip a bit inside the first data block, which holds the smallest key
+	b[2] ^= 0x01
+	if err := os.WriteFile(segPath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := nob.Get(seg.smallest); err != errCorruptBlock {
+		t.Fatalf("got %v want %v", err, errCorruptBlock)
+	}
+}
+
+func TestUnreadableSegmentIsAnError(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("key%02d", i), "val")
+	}
+
+	nob.waitForFlushes()
+	seg := nob.currentVersion().levels[0][0]
+	segPath := path.Join(tdir, seg.name)
+	b, err := os.ReadFile(segPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a version from the future
+	binary.LittleEndian.PutUint32(b[len(b)-8:], 99)
+	if err := os.WriteFile(segPath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := nob.Get(seg.smallest); err == nil || err == ErrKeyNotFound {
+		t.Fatalf("got %v %v, want a read error", got, err)
+	}
+}
+
+func TestCorruptBlockStopsScanAndCompaction(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNobWithStrategy(t, tdir, NewSizeTieredStrategy())
+	// keep the scheduler from compacting before the block is corrupted
+	nob.compactMu.Lock()
+	for i := range 40 {
+		_ = nob.Set(fmt.Sprintf("key%02d", i), "val")
+	}
+
+	nob.waitForFlushes()
+	before := nob.currentVersion().all()
+	seg := before[0]
+	segPath := path.Join(tdir, seg.name)
+	b, err := os.ReadFile(segPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[2] ^= 0x01
+	if err := os.WriteFile(segPath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	it := nob.Scan("", "")
+	for it.Next() {
+	}
+	it.Close()
+	if err := it.Err(); !errors.Is(err, errCorruptBlock) {
+		t.Fatalf("scan stopped with %v", err)
+	}
+
+	nob.compactMu.Unlock()
+	nob.mergeCompact()
+	if after := nob.currentVersion().all(); len(after) != len(before) {
+		t.Fatalf("compaction went ahead over a corrupt block: %v files, had %v", len(after), len(before))
+	}
+	for _, f := range before {
+		if _, err := os.Stat(path.Join(tdir, f.name)); err != nil {
+			t.Fatalf("input %v is gone: %v", f.name, err)
+		}
+	}
+}
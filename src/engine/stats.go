@@ -0,0 +1,34 @@
+package engine
+
+// Stats is a point in time view of the memtables & write sequence. Bytes count keys, values & the
+// nodes holding them, the same as the MemtableSize budget does.
+type Stats struct {
+	// MemtableBytes & MemtableEntries describe the memtable taking writes
+	MemtableBytes   int64
+	MemtableEntries int
+	// MemtableBudget is the bytes the memtable is frozen past
+	MemtableBudget int64
+	// FrozenMemtables are waiting for the flusher, holding FrozenBytes & FrozenEntries
+	FrozenMemtables int
+	FrozenBytes     int64
+	FrozenEntries   int
+	// LastSequence numbers the latest write
+	LastSequence uint64
+}
+
+func (nob *Nob) Stats() Stats {
+	nob.mu.RLock()
+	defer nob.mu.RUnlock()
+	s := Stats{
+		MemtableBytes:   int64(nob.memtable.GetSize()),
+		MemtableEntries: nob.memtable.Len(),
+		MemtableBudget:  nob.opts.MemtableSize,
+		FrozenMemtables: len(nob.immutables),
+		LastSequence:    nob.lastSeq.Load(),
+	}
+	for _, imm := range nob.immutables {
+		s.FrozenBytes += int64(imm.memtable.GetSize())
+		s.FrozenEntries += imm.memtable.Len()
+	}
+	return s
+}
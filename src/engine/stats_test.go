@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStatsCountEntriesAndBytes(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("foo", "bar")
+	_ = nob.Set("baz", "qux")
+	s := nob.Stats()
+	if s.MemtableEntries != 2 || s.MemtableBudget != 400 {
+		t.Fatalf("got %+v", s)
+	}
+	// nodes count too
+	if s.MemtableBytes <= int64(len("foo+bar")+len("baz+qux")) {
+		t.Fatalf("got %v bytes", s.MemtableBytes)
+	}
+}
+
+func TestHotKeyDoesntFillMemtable(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("loco", "caitanlakdkerfxkvladsf;kajsdf")
+	before := nob.Stats()
+	for range 300 {
+		_ = nob.Set("loco", "caitanlakdkerfxkvladsf;kajsdf")
+	}
+	after := nob.Stats()
+	before.LastSequence += 300
+	if after != before || after.FrozenMemtables != 0 {
+		t.Fatalf("overwrites changed the memtable from %+v to %+v", before, after)
+	}
+	nob.waitForFlushes()
+	if n := len(nob.currentVersion().all()); n != 0 {
+		t.Fatalf("flushed %v segments of a single key", n)
+	}
+}
+
+func TestMemtableFrozenPastBudget(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	for i := range 100 {
+		_ = nob.Set(fmt.Sprintf("key%03d", i), "val")
+		if s := nob.Stats(); s.MemtableBytes > s.MemtableBudget {
+			t.Fatalf("memtable at %v bytes, budget %v", s.MemtableBytes, s.MemtableBudget)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+// NO_TTL is the TTL of a key that never expires
+const NO_TTL time.Duration = -1
+
+var errBadTTL = errors.New("ttl must be positive")
+
+// markExpiring(val, expiry) marks a value that reads as absent from expiry on
+//
+//	| EXPIRING_MARKER | expiry (unix nanoseconds, 8, big endian) | val |
+func markExpiring(val string, expiry time.Time) string {
+	b := make([]byte, 9, 9+len(val))
+	b[0] = EXPIRING_MARKER
+	binary.BigEndian.PutUint64(b[1:], uint64(expiry.UnixNano()))
+	return string(append(b, val...))
+}
+
+// splitExpiring(raw) returns the value & expiry of an expiring marked value
+func splitExpiring(raw string) (string, time.Time) {
+	if len(raw) < 9 {
+		// torn, never readable
+		return "", time.Time{}
+	}
+	return raw[9:], time.Unix(0, int64(binary.BigEndian.Uint64([]byte(raw[1:9]))))
+}
+
+// SetWithTTL(key, val, ttl) is Set for a value that reads as absent once ttl has
+// passed. Compactions drop it from then on.
+func (nob *Nob) SetWithTTL(key, val string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errBadTTL
+	}
+	return nob.put(key, markExpiring(val, time.Now().Add(ttl)))
+}
+
+// SetWithTTL(key, val, ttl) adds a Nob.SetWithTTL to b, ttl counting from now.
+// A ttl of 0 or less writes a value that is already expired.
+func (b *WriteBatch) SetWithTTL(key, val string, ttl time.Duration) {
+	b.entries = append(b.entries, util.Entry{Key: key, Value: markExpiring(val, time.Now().Add(ttl))})
+}
+
+// TTL(key) returns how long key has left to live, NO_TTL if it doesn't expire
+func (nob *Nob) TTL(key string) (time.Duration, error) {
+	raw, _, found, err := nob.lookup(key, MAX_SEQUENCE)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, ErrKeyNotFound
+	}
+	if _, live := unmarkValue(raw); !live {
+		return 0, ErrKeyNotFound
+	}
+	if raw[0] != EXPIRING_MARKER {
+		return NO_TTL, nil
+	}
+	_, expiry := splitExpiring(raw)
+	// it may expire in between, the remaining lifetime never goes below zero
+	return max(time.Until(expiry), 0), nil
+}
@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiredKeysReadAsAbsent(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("old", "shadowed")
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("junk%02d", i), "values")
+	}
+	nob.waitForFlushes()
+
+	if err := nob.SetWithTTL("old", "session", 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	_ = nob.SetWithTTL("token", "abc", time.Hour)
+	_ = nob.Set("plain", "val")
+	if err := nob.SetWithTTL("bad", "val", 0); err == nil {
+		t.Fatal("a ttl of 0 was accepted")
+	}
+
+	if got, err := nob.Get("old"); err != nil || got != "session" {
+		t.Fatalf("got %v %v before expiry", got, err)
+	}
+	if ttl, err := nob.TTL("token"); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("token ttl %v %v", ttl, err)
+	}
+	if ttl, err := nob.TTL("plain"); err != nil || ttl != NO_TTL {
+		t.Fatalf("plain ttl %v %v", ttl, err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	// the expired value hides the older one like a tombstone
+	if got, err := nob.Get("old"); err != ErrKeyNotFound {
+		t.Fatalf("got %v %v after expiry", got, err)
+	}
+	if _, err := nob.TTL("old"); err != ErrKeyNotFound {
+		t.Fatalf("ttl of an expired key got %v", err)
+	}
+	if got := collect(nob.Scan("", "junk")); fmt.Sprint(got) != "map[]" {
+		t.Fatalf("scanned %v", got)
+	}
+	if _, err := nob.SetIfAbsent("old", "new session"); err != nil {
+		t.Fatalf("expired key isn't absent: %v", err)
+	}
+}
+
+func TestExpiryIsPersisted(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	_ = nob.SetWithTTL("token", "abc", time.Hour)
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("junk%02d", i), "values")
+	}
+	nob.mergeCompact()
+	_ = nob.Close()
+
+	restarted := getNob(t, tdir)
+	if got, err := restarted.Get("token"); err != nil || got != "abc" {
+		t.Fatalf("got %v %v", got, err)
+	}
+	if ttl, err := restarted.TTL("token"); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("token ttl %v %v after restart", ttl, err)
+	}
+}
+
+func TestCompactionDropsExpiredKeys(t *testing.T) {
+	// a full size-tiered compaction rewrites everything into a single file
+	nob := getNobWithStrategy(t, t.TempDir(), NewSizeTieredStrategy())
+	for i := range 10 {
+		_ = nob.SetWithTTL(fmt.Sprintf("session%v", i), "token", 50*time.Millisecond)
+	}
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("junk%02d", i), "values")
+	}
+	time.Sleep(100 * time.Millisecond)
+	nob.mergeCompact()
+
+	for _, f := range nob.currentVersion().all() {
+		table, err := openSSTable(path.Join(nob.rootDir, f.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		it := table.iterator("session")
+		for it.next() {
+			if key := userKeyOf(it.key()); key >= "session" && key < "sessioo" {
+				t.Fatalf("expired %v is still in %v", key, f.name)
+			}
+		}
+		it.close()
+	}
+}
+
+func TestValuesStayOutOfTheLog(t *testing.T) {
+	var logged strings.Builder
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	nob := getNob(t, t.TempDir())
+	const secret = "s3cr3t-session-token"
+	_ = nob.SetWithTTL("session", secret, time.Hour)
+	_ = nob.Set("counter", secret)
+	// an operand the counter can't take, written by a batch so reads & compactions fail on it
+	b := NewWriteBatch()
+	b.Merge("counter", "1")
+	_ = nob.Write(b)
+	for i := range 20 {
+		_ = nob.Set(fmt.Sprintf("junk%02d", i), secret)
+	}
+	_, _ = nob.Get("session")
+	_, _ = nob.Get("counter")
+	_, _ = nob.Get("junk00")
+	nob.mergeCompact()
+	_, _ = nob.Get("counter")
+
+	if strings.Contains(logged.String(), secret) {
+		t.Fatalf("a value was logged:\n%v", logged.String())
+	}
+}
@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"errors"
+	"maps"
+	"slices"
+)
+
+// ErrConflict fails a Commit when a key the transaction read was written after it began
+var ErrConflict = errors.New("transaction conflict")
+
+// ErrTxnDone is returned by transactions already committed or rolled back
+var ErrTxnDone = errors.New("transaction already done")
+
+// Txn is an optimistic transaction. It reads the database as of Begin, buffers its
+// writes and applies them as a single WriteBatch on Commit, unless a key it read has
+// been written since. Nothing is locked until Commit, conflicts are found then.
+type Txn struct {
+	nob *Nob
+	seq uint64
+	// snap pins what the transaction reads, and every version written since
+	snap *Snapshot
+	// reads are the keys Get was called for, found or not
+	reads map[string]bool
+	// writes hold the marked value of every key written, for reading them back
+	writes map[string]string
+	batch  *WriteBatch
+	done   bool
+}
+
+// Begin() starts a transaction reading the database as of now.
+// It must be committed or rolled back to release what it reads.
+func (nob *Nob) Begin() *Txn {
+	snap := nob.Snapshot()
+	return &Txn{nob: nob, seq: snap.seq, snap: snap, reads: map[string]bool{}, writes: map[string]string{}, batch: NewWriteBatch()}
+}
+
+// Seq() numbers the latest write txn reads
+func (txn *Txn) Seq() uint64 {
+	return txn.seq
+}
+
+// Get(key) returns what txn wrote to key, or else its value when txn began.
+// Only keys read from the database take part in conflict detection.
+func (txn *Txn) Get(key string) (string, error) {
+	if txn.done {
+		return "", ErrTxnDone
+	}
+	if raw, ok := txn.writes[key]; ok {
+		val, live := unmarkValue(raw)
+		if !live {
+			return "", ErrKeyNotFound
+		}
+		return val, nil
+	}
+	txn.reads[key] = true
+	return txn.nob.get(key, txn.seq)
+}
+
+func (txn *Txn) Set(key, val string) {
+	txn.batch.Set(key, val)
+	txn.writes[key] = string(VALUE_MARKER) + val
+}
+
+func (txn *Txn) Delete(key string) {
+	txn.batch.Delete(key)
+	txn.writes[key] = string(TOMBSTONE_MARKER)
+}
+
+// Commit() atomically applies the writes of txn, or fails with ErrConflict if a key
+// txn read was written after it began. txn is done either way.
+//
+// The reads are checked before writers are held off, then only writes made meanwhile,
+// which are still in memory unless a flush beat the commit to writeMu.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.Rollback()
+
+	nob := txn.nob
+	at := nob.lastSeq.Load()
+	if err := txn.checkReads(at); err != nil {
+		return err
+	}
+
+	nob.writeMu.Lock()
+	defer nob.writeMu.Unlock()
+	written, ok := nob.writtenSince(slices.Collect(maps.Keys(txn.reads)), at)
+	if !ok {
+		if err := txn.checkReads(MAX_SEQUENCE); err != nil {
+			return err
+		}
+	} else if written {
+		return ErrConflict
+	}
+	if txn.batch.Len() == 0 {
+		return nil
+	}
+	return nob.write(txn.batch)
+}
+
+// checkReads(at) fails with ErrConflict if a key txn read was written after it began,
+// as of at
+func (txn *Txn) checkReads(at uint64) error {
+	for key := range txn.reads {
+		// compactions keep every version newer than the snapshot of txn, tombstones
+		// & expired values included, so a later write always shows
+		_, seq, found, err := txn.nob.lookupVersion(key, at)
+		if err != nil {
+			return err
+		}
+		if found && seq > txn.seq {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// Rollback() discards the writes of txn. Rolling back a done transaction is a no-op.
+func (txn *Txn) Rollback() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+	txn.snap.Release()
+}
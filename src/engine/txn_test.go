@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+func TestTxnCommitsItsWrites(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("a", "1")
+	_ = nob.Set("b", "1")
+
+	txn := nob.Begin()
+	_ = nob.Set("c", "written after begin")
+	if got, err := txn.Get("a"); err != nil || got != "1" {
+		t.Fatalf("got %v %v", got, err)
+	}
+	txn.Set("a", "2")
+	txn.Delete("b")
+	if got, _ := txn.Get("a"); got != "2" {
+		t.Fatalf("txn doesn't read its own write, got %v", got)
+	}
+	if _, err := txn.Get("b"); err != ErrKeyNotFound {
+		t.Fatalf("txn doesn't read its own delete, got %v", err)
+	}
+	if got, _ := nob.Get("a"); got != "1" {
+		t.Fatalf("uncommitted write visible, got %v", got)
+	}
+
+	// c was written but never read by txn
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := nob.Get("a"); got != "2" {
+		t.Fatalf("got %v", got)
+	}
+	if _, err := nob.Get("b"); err != ErrKeyNotFound {
+		t.Fatalf("got %v", err)
+	}
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Fatalf("second commit got %v", err)
+	}
+}
+
+func TestTxnConflicts(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("x", "1")
+
+	cases := map[string]func(){
+		"overwritten": func() { _ = nob.Set("x", "theirs") },
+		"deleted":     func() { _ = nob.Delete("x") },
+		"flushed & compacted": func() {
+			_ = nob.Set("x", "theirs")
+			for i := range 20 {
+				_ = nob.Set(fmt.Sprintf("junk%02d", i), "values")
+			}
+			nob.mergeCompact()
+		},
+		// a full compaction drops tombstones no snapshot needs
+		"deleted & compacted": func() {
+			_ = nob.Delete("x")
+			for i := range 20 {
+				_ = nob.Set(fmt.Sprintf("junk%02d", i), "values")
+			}
+			nob.mergeCompact()
+		},
+	}
+	for name, interfere := range cases {
+		t.Run(name, func(t *testing.T) {
+			_ = nob.Set("x", "1")
+			txn := nob.Begin()
+			_, _ = txn.Get("x")
+			interfere()
+			txn.Set("x", "mine")
+			if err := txn.Commit(); err != ErrConflict {
+				t.Fatalf("got %v want %v", err, ErrConflict)
+			}
+			if got, _ := nob.Get("x"); got == "mine" {
+				t.Fatal("conflicting txn was applied")
+			}
+		})
+	}
+
+	// a key read while absent conflicts with it being created
+	txn := nob.Begin()
+	if _, err := txn.Get("fresh"); err != ErrKeyNotFound {
+		t.Fatal(err)
+	}
+	_ = nob.Set("fresh", "theirs")
+	txn.Set("fresh", "mine")
+	if err := txn.Commit(); err != ErrConflict {
+		t.Fatalf("got %v want %v", err, ErrConflict)
+	}
+}
+
+func TestWrittenSinceOnlyTrustsMemtables(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("x", "1")
+	at := nob.LastSequence()
+
+	nob.writeMu.Lock()
+	defer nob.writeMu.Unlock()
+	if written, ok := nob.writtenSince([]string{"x", "y"}, at); written || !ok {
+		t.Fatalf("got %v %v want nothing written", written, ok)
+	}
+	_ = nob.write(&WriteBatch{entries: []util.Entry{{Key: "y", Value: string(VALUE_MARKER) + "2"}}})
+	if written, ok := nob.writtenSince([]string{"x", "y"}, at); !written || !ok {
+		t.Fatalf("got %v %v want y written", written, ok)
+	}
+
+	// once a write after at is flushed, only the segments can tell
+	nob.freezeMemtable()
+	nob.waitForFlushes()
+	if _, ok := nob.writtenSince([]string{"x"}, at); ok {
+		t.Fatal("a flushed write can't be ruled out from memory")
+	}
+}
+
+func TestTxnRollbackDiscardsWrites(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	txn := nob.Begin()
+	txn.Set("a", "1")
+	txn.Rollback()
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := nob.Get("a"); err != ErrKeyNotFound {
+		t.Fatalf("got %v", err)
+	}
+	if n := len(nob.liveSnapshots()); n != 0 {
+		t.Fatalf("%v snapshots left behind", n)
+	}
+}
+
+func TestTxnCountersDontLoseIncrements(t *testing.T) {
+	nob := getNob(t, t.TempDir())
+	_ = nob.Set("counter", "0")
+
+	var wg sync.WaitGroup
+	conflicts := 0
+	var mu sync.Mutex
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				for {
+					txn := nob.Begin()
+					val, _ := txn.Get("counter")
+					n, _ := strconv.Atoi(val)
+					txn.Set("counter", strconv.Itoa(n+1))
+					err := txn.Commit()
+					if err == nil {
+						break
+					}
+					if err != ErrConflict {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					conflicts++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, _ := nob.Get("counter"); got != "200" {
+		t.Fatalf("got %v after 200 increments (%v conflicts)", got, conflicts)
+	}
+}
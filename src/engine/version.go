@@ -0,0 +1,290 @@
+package engine
+
+import (
+	"cmp"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+const NUM_LEVELS = 4
+
+// fileMeta describes a live segment file and the range of keys it holds
+type fileMeta struct {
+	name     string
+	level    int
+	size     int64
+	smallest string
+	largest  string
+	// smallestSeq & largestSeq number the oldest & latest write the file holds,
+	// both 0 for files written before sequence numbers
+	smallestSeq uint64
+	largestSeq  uint64
+	// bloom is loaded from the segment's sidecar file, it isn't part of the manifest
+	bloom *util.BloomFilter
+	// refs counts the versions holding the file. It's only taken with nob.mu read locked,
+	// for the current version, and released with it locked.
+	refs atomic.Int64
+}
+
+// version is the set of live segment files, by level.
+//
+// L0 holds memtable flushes which may overlap, newest first by the latest write they hold.
+// L1..Ln each hold non-overlapping files sorted by key, every level older
+// than the one above it.
+//
+// A published version is never modified, readers use it without holding nob.mu.
+// Edits are made to a clone by logAndApply.
+type version struct {
+	levels [NUM_LEVELS][]*fileMeta
+	// lastSeq numbers the latest write flushed into any file of the version
+	lastSeq uint64
+}
+
+// clone() copies the file lists of v, sharing their fileMeta
+func (v *version) clone() *version {
+	c := &version{lastSeq: v.lastSeq}
+	for level, files := range v.levels {
+		c.levels[level] = append([]*fileMeta{}, files...)
+	}
+	return c
+}
+
+// ref() pins the files of v, call with nob.mu held
+func (v *version) ref() {
+	for _, f := range v.all() {
+		f.refs.Add(1)
+	}
+}
+
+// unref() releases the files of v and returns those no version holds anymore,
+// call with nob.mu held
+func (v *version) unref() []*fileMeta {
+	var dead []*fileMeta
+	for _, f := range v.all() {
+		if f.refs.Add(-1) == 0 {
+			dead = append(dead, f)
+		}
+	}
+	return dead
+}
+
+func (f *fileMeta) overlaps(smallest, largest string) bool {
+	return f.smallest <= largest && smallest <= f.largest
+}
+
+// candidates(key) returns the files that may hold key, newest first.
+// That's every file in L0 but at most one file for each level below.
+func (v *version) candidates(key string) []*fileMeta {
+	res := append([]*fileMeta{}, v.levels[0]...)
+	for level := 1; level < NUM_LEVELS; level++ {
+		files := v.levels[level]
+		i := sort.Search(len(files), func(i int) bool {
+			return files[i].largest >= key
+		})
+		if i < len(files) && files[i].smallest <= key {
+			res = append(res, files[i])
+		}
+	}
+	return res
+}
+
+// all() returns every live file, newest first
+func (v *version) all() []*fileMeta {
+	var res []*fileMeta
+	for _, files := range v.levels {
+		res = append(res, files...)
+	}
+	return res
+}
+
+// overlapping(level, smallest, largest) returns the files of level intersecting [smallest, largest]
+func (v *version) overlapping(level int, smallest, largest string) []*fileMeta {
+	var res []*fileMeta
+	for _, f := range v.levels[level] {
+		if f.overlaps(smallest, largest) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+func (v *version) levelSize(level int) int64 {
+	var size int64
+	for _, f := range v.levels[level] {
+		size += f.size
+	}
+	return size
+}
+
+// addFile(f) makes f live in f.level
+func (v *version) addFile(f *fileMeta) {
+	if f.level == 0 {
+		v.levels[0] = append([]*fileMeta{f}, v.levels[0]...)
+		return
+	}
+	files := append(v.levels[f.level], f)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].smallest < files[j].smallest
+	})
+	v.levels[f.level] = files
+}
+
+// apply(e) makes the changes of e to v.
+// L0 files added alongside deleted L0 files take the place of the newest one deleted,
+// others, like flushes, go first. L0 is then ordered by largestSeq, files written
+// before sequence numbers keeping their place among each other.
+func (v *version) apply(e *versionEdit) {
+	deleted := map[string]bool{}
+	for _, name := range e.deleted {
+		deleted[name] = true
+	}
+	pos := 0
+	for i, f := range v.levels[0] {
+		if deleted[f.name] {
+			pos = i
+			break
+		}
+	}
+
+	for level, lf := range v.levels {
+		var kept []*fileMeta
+		for _, f := range lf {
+			if !deleted[f.name] {
+				kept = append(kept, f)
+			}
+		}
+		v.levels[level] = kept
+	}
+	for _, f := range e.added {
+		if f.level != 0 {
+			v.addFile(f)
+			continue
+		}
+		v.levels[0] = slices.Insert(v.levels[0], pos, f)
+		pos++
+	}
+	sortBySeq(v.levels[0])
+	v.lastSeq = max(v.lastSeq, e.lastSeq)
+}
+
+// sortBySeq(files) orders files newest first by the latest write they hold, keeping
+// the order of files with the same largestSeq
+func sortBySeq(files []*fileMeta) {
+	slices.SortStableFunc(files, func(a, b *fileMeta) int {
+		return cmp.Compare(b.largestSeq, a.largestSeq)
+	})
+}
+
+// currentVersion() returns the latest published version
+func (nob *Nob) currentVersion() *version {
+	nob.mu.RLock()
+	defer nob.mu.RUnlock()
+	return nob.version
+}
+
+// logAndApply(e) persists e to the manifest, then publishes a clone of the current version
+// changed by e. Files only the previous version held are deleted once no reader uses them anymore.
+func (nob *Nob) logAndApply(e *versionEdit) {
+	nob.manifestMu.Lock()
+	defer nob.manifestMu.Unlock()
+
+	// only logAndApply publishes versions, so old stays current until then
+	old := nob.currentVersion()
+	v := old.clone()
+	v.apply(e)
+	// compaction inputs must outlive the last manifest naming them
+	nob.logEdit(e, v)
+
+	nob.mu.Lock()
+	v.ref()
+	nob.version = v
+	nob.mu.Unlock()
+
+	nob.releaseVersion(old)
+}
+
+// releaseVersion(v) drops a reference to v, deleting the files nothing holds anymore
+func (nob *Nob) releaseVersion(v *version) {
+	nob.mu.Lock()
+	dead := v.unref()
+	nob.mu.Unlock()
+
+	for _, f := range dead {
+		nob.removeSegment(f.name)
+	}
+}
+
+// removeSegment(segName) deletes a segment that is no longer live and its sidecars
+func (nob *Nob) removeSegment(segName string) {
+	err := os.Remove(path.Join(nob.rootDir, segName))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// text segments have an index, older ones no bloom filter
+	for _, sidecar := range []string{indexNameOf(segName), bloomNameOf(segName)} {
+		err = os.Remove(path.Join(nob.rootDir, sidecar))
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// buildVersion(liveNames) places files found without a manifest into L0, since older
+// layouts may overlap, ordered newest first by sequence number. Files written before
+// sequence numbers fall back to their segment number.
+func (nob *Nob) buildVersion(liveNames []string) (*version, error) {
+	v := &version{}
+	var files []*fileMeta
+	for _, name := range liveNames {
+		f, err := nob.describeFile(name, 0)
+		if err != nil {
+			return nil, err
+		}
+		v.lastSeq = max(v.lastSeq, f.largestSeq)
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return segNoOf(files[i].name) > segNoOf(files[j].name)
+	})
+	sortBySeq(files)
+	v.levels[0] = files
+	return v, nil
+}
+
+// describeFile(name, level) reads the key & sequence number ranges and size of an existing segment file
+func (nob *Nob) describeFile(name string, level int) (*fileMeta, error) {
+	segPath := path.Join(nob.rootDir, name)
+	info, err := os.Stat(segPath)
+	if err != nil {
+		return nil, err
+	}
+	meta := &fileMeta{name: name, level: level, size: info.Size()}
+
+	it := nob.newSegmentIterator(segPath, "")
+	defer it.close()
+	for i := 0; it.next(); i++ {
+		key, seq := parseInternalKey(it.key())
+		if i == 0 {
+			meta.smallest, meta.smallestSeq = key, seq
+		}
+		meta.largest = key
+		meta.smallestSeq = min(meta.smallestSeq, seq)
+		meta.largestSeq = max(meta.largestSeq, seq)
+	}
+	return meta, it.err()
+}
+
+func segNoOf(name string) int {
+	segNo, err := strconv.Atoi(dataFileRxp.FindStringSubmatch(name)[2])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return segNo
+}
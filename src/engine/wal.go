@@ -0,0 +1,256 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+
+	"git.target.com/eric.miranda/mydb/v2/src/util"
+)
+
+const WAL_NAME = "wal"
+
+// WAL_MAGIC starts every wal
+const WAL_MAGIC = "NOBWAL2\n"
+
+// wal is an append-only redo log of memtable inserts.
+// Every record is fsynced before Set returns, so anything acknowledged
+// can be replayed into a fresh memtable after a crash.
+//
+// A record holds a whole WriteBatch, a Set being a batch of one, its entries
+// numbered from the sequence number of the first:
+//
+//	| crc32 (4) | payload len (4) | seq (uvarint) | entry | entry | ...
+//
+// entry layout:
+//
+//	| key len (uvarint) | key | val len (uvarint) | val |
+type wal struct {
+	file *os.File
+}
+
+// MAX_RECORD_SIZE bounds the payload of a wal or manifest record, so a corrupt length
+// can't make replay allocate more than that
+const MAX_RECORD_SIZE = 64 << 20
+
+var errCorruptRecord = errors.New("corrupt wal record")
+
+// errRecordTooLarge fails appends of a payload over MAX_RECORD_SIZE
+var errRecordTooLarge = errors.New("wal record too large")
+
+// openWal(rootDir) opens (or creates) the wal in rootDir for appending
+func openWal(rootDir string) (*wal, error) {
+	return openWalFile(path.Join(rootDir, WAL_NAME))
+}
+
+// openWalFile(p) writes WAL_MAGIC to a new wal. A wal too short to hold it was torn
+// before any record was acknowledged, and is started over.
+func openWalFile(p string) (*wal, error) {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if info.Size() < int64(len(WAL_MAGIC)) {
+		if err := f.Truncate(0); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		if _, err := f.WriteString(WAL_MAGIC); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return &wal{file: f}, f.Sync()
+	}
+
+	magic := make([]byte, len(WAL_MAGIC))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if string(magic) != WAL_MAGIC {
+		_ = f.Close()
+		return nil, fmt.Errorf("%v: not a wal", p)
+	}
+	return &wal{file: f}, nil
+}
+
+// walNameOf(segName) names the wal of a frozen memtable that is flushed to segName
+func walNameOf(segName string) string {
+	return fmt.Sprintf("wal_%v", segName)
+}
+
+// replayWalFile(p, fn) replays the wal of a frozen memtable, which is never appended to again
+func replayWalFile(p string, fn func(seq uint64, key, val string)) error {
+	w, err := openWalFile(p)
+	if err != nil {
+		return err
+	}
+	defer w.close()
+	return w.replay(fn)
+}
+
+// append(seq, entries) writes entries, numbered from seq, as a single record and syncs it to disk
+func (w *wal) append(seq uint64, entries []util.Entry) error {
+	payload := binary.AppendUvarint(nil, seq)
+	for _, e := range entries {
+		payload = appendWalEntry(payload, e)
+	}
+	return appendRecord(w.file, payload)
+}
+
+func appendWalEntry(payload []byte, e util.Entry) []byte {
+	payload = binary.AppendUvarint(payload, uint64(len(e.Key)))
+	payload = append(payload, e.Key...)
+	payload = binary.AppendUvarint(payload, uint64(len(e.Value)))
+	return append(payload, e.Value...)
+}
+
+// replay(fn) calls fn for every entry of every intact record in order of writing.
+// A torn or corrupt tail (a crash mid-append) is truncated away, since those
+// writes were never acknowledged.
+func (w *wal) replay(fn func(seq uint64, key, val string)) error {
+	return replayRecords(w.file, int64(len(WAL_MAGIC)), func(payload []byte) error {
+		seq, n := binary.Uvarint(payload)
+		if n <= 0 || seq == 0 {
+			return errCorruptRecord
+		}
+		// decoded whole first, a record is replayed entirely or not at all
+		entries, err := decodeWalPayload(payload[n:])
+		if err != nil {
+			return err
+		}
+		for i, e := range entries {
+			fn(seq+uint64(i), e.Key, e.Value)
+		}
+		return nil
+	})
+}
+
+func decodeWalPayload(payload []byte) ([]util.Entry, error) {
+	var entries []util.Entry
+	for len(payload) > 0 {
+		keyLen, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < keyLen {
+			return nil, errCorruptRecord
+		}
+		payload = payload[n:]
+		key := string(payload[:keyLen])
+		payload = payload[keyLen:]
+
+		valLen, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < valLen {
+			return nil, errCorruptRecord
+		}
+		payload = payload[n:]
+		entries = append(entries, util.Entry{Key: key, Value: string(payload[:valLen])})
+		payload = payload[valLen:]
+	}
+	if len(entries) == 0 {
+		return nil, errCorruptRecord
+	}
+	return entries, nil
+}
+
+// appendRecord(f, payload) writes payload framed by its crc & length and syncs it to disk
+func appendRecord(f *os.File, payload []byte) error {
+	if len(payload) > MAX_RECORD_SIZE {
+		return fmt.Errorf("%w: %v bytes", errRecordTooLarge, len(payload))
+	}
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:4], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(payload)))
+
+	if _, err := f.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// replayRecords(f, start, fn) calls fn for every intact record from offset start on.
+// Everything from the first torn record, or one fn rejects, is truncated away
+// and f is left positioned for appending.
+func replayRecords(f *os.File, start int64, fn func(payload []byte) error) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(f)
+
+	goodOffset := start
+	for {
+		payload, n, err := readRecord(reader, info.Size()-goodOffset)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = fn(payload)
+		}
+		if err != nil {
+			// everything after goodOffset is garbage
+			if err := f.Truncate(goodOffset); err != nil {
+				return err
+			}
+			break
+		}
+		goodOffset += n
+	}
+
+	_, err = f.Seek(goodOffset, io.SeekStart)
+	return err
+}
+
+// readRecord(r, remaining) returns the next payload and its size on disk, remaining
+// being the bytes left to read. A length over either bound is corrupt like a torn record.
+func readRecord(r *bufio.Reader, remaining int64) ([]byte, int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errCorruptRecord
+	}
+	crc := binary.LittleEndian.Uint32(header[0:4])
+	size := int64(binary.LittleEndian.Uint32(header[4:8]))
+	if size > MAX_RECORD_SIZE || size > remaining-int64(len(header)) {
+		return nil, 0, errCorruptRecord
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, errCorruptRecord
+	}
+	if crc32.ChecksumIEEE(payload) != crc {
+		return nil, 0, errCorruptRecord
+	}
+	return payload, int64(len(header) + len(payload)), nil
+}
+
+// rotate(rootDir, segName) hands the wal over to the memtable frozen for segName
+// and returns an empty wal for the next memtable
+func (w *wal) rotate(rootDir, segName string) (*wal, error) {
+	if err := w.close(); err != nil {
+		return nil, err
+	}
+	err := os.Rename(path.Join(rootDir, WAL_NAME), path.Join(rootDir, walNameOf(segName)))
+	if err != nil {
+		return nil, err
+	}
+	syncDir(rootDir)
+	return openWal(rootDir)
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
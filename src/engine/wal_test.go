@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWalReplay(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	err := nob.Set("foo", "bar baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nob.Set("foo", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nob.Set("fin", "bean")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "crash" and restart
+	_ = nob.Close()
+	restarted := getNob(t, tdir)
+
+	for k, want := range map[string]string{"foo": "latest", "fin": "bean"} {
+		got, err := restarted.Get(k)
+		if err != nil || got != want {
+			t.Fatalf("got %v want %v", got, want)
+		}
+	}
+}
+
+func TestWalTornTail(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	err := nob.Set("foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash halfway through an append
+	f, err := os.OpenFile(path.Join(tdir, WAL_NAME), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte{0xde, 0xad, 0xbe})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	_ = nob.Close()
+	restarted := getNob(t, tdir)
+	got, err := restarted.Get("foo")
+	if err != nil || got != "bar" {
+		t.Fatalf("got %v want %v", got, "bar")
+	}
+
+	// appends after the truncated tail must replay too
+	err = restarted.Set("baz", "23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = restarted.Close()
+	again := getNob(t, tdir)
+	got, err = again.Get("baz")
+	if err != nil || got != "23" {
+		t.Fatalf("got %v want %v", got, "23")
+	}
+}
+
+func TestWalOversizedLengthIsATornTail(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	_ = nob.Set("foo", "bar")
+	intact, err := os.Stat(path.Join(tdir, WAL_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a header claiming a payload of nearly 4GB
+	f, err := os.OpenFile(path.Join(tdir, WAL_NAME), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte{0, 0, 0, 0, 0xf0, 0xff, 0xff, 0xff, 1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	_ = nob.Close()
+	restarted := getNob(t, tdir)
+	if got, err := restarted.Get("foo"); err != nil || got != "bar" {
+		t.Fatalf("got %v %v", got, err)
+	}
+	info, err := os.Stat(path.Join(tdir, WAL_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != intact.Size() {
+		t.Fatalf("wal of %v bytes wasn't truncated to %v", info.Size(), intact.Size())
+	}
+}
+
+func TestWalResetOnFlush(t *testing.T) {
+	tdir := t.TempDir()
+	nob := getNob(t, tdir)
+	for i := range 5 {
+		err := nob.Set(fmt.Sprintf("ottff%v", i), "stkerjfnxkfalgktxadjklxad")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := os.Stat(path.Join(tdir, WAL_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(WAL_MAGIC)) {
+		t.Fatalf("wal size %v should've been empty after flush", info.Size())
+	}
+}
@@ -0,0 +1,231 @@
+package util
+
+import "unsafe"
+
+// AVLMap is an ordered string map kept balanced as an AVL tree, so sequential keys
+// can't degrade it to a list the way they do a TreeMap.
+//
+// It's persistent: nodes are never modified once built, Insert & Delete copy the
+// path down to the key instead. A Snapshot() is therefore free and never changes,
+// and can be read while the map it was taken from is written to.
+type AVLMap struct {
+	root *avlNode
+	// size is the bytes held by keys, values & nodes, len the number of keys
+	size int
+	len  int
+}
+
+type avlNode struct {
+	key    string
+	value  string
+	left   *avlNode
+	right  *avlNode
+	height int
+}
+
+// AVL_NODE_SIZE is the bytes a node takes besides its key & value.
+// Nodes copied by an Insert or Delete are garbage as soon as no Snapshot holds them.
+const AVL_NODE_SIZE = int(unsafe.Sizeof(avlNode{}))
+
+func NewAVLMap() *AVLMap {
+	return &AVLMap{}
+}
+
+// Insert(key, value) adds key or overwrites its value
+func (m *AVLMap) Insert(key, value string) {
+	var old *avlNode
+	m.root, old = insertNode(m.root, key, value)
+	if old != nil {
+		m.size += len(value) - len(old.value)
+		return
+	}
+	m.size += AVL_NODE_SIZE + len(key) + len(value)
+	m.len++
+}
+
+// Delete(key) removes key, returning false if it wasn't there
+func (m *AVLMap) Delete(key string) bool {
+	var old *avlNode
+	m.root, old = deleteNode(m.root, key)
+	if old == nil {
+		return false
+	}
+	m.size -= AVL_NODE_SIZE + len(old.key) + len(old.value)
+	m.len--
+	return true
+}
+
+func (m *AVLMap) Get(key string) (string, bool) {
+	n := m.root
+	for n != nil {
+		switch {
+		case key < n.key:
+			n = n.left
+		case key > n.key:
+			n = n.right
+		default:
+			return n.value, true
+		}
+	}
+	return "", false
+}
+
+// GetSize() returns the bytes held by every key, value & node
+func (m *AVLMap) GetSize() int {
+	return m.size
+}
+
+// Len() returns the number of keys
+func (m *AVLMap) Len() int {
+	return m.len
+}
+
+func (m *AVLMap) Concurrent() bool {
+	return false
+}
+
+// Snapshot() returns a read-only copy of m as it is now, in O(1)
+func (m *AVLMap) Snapshot() *AVLMap {
+	c := *m
+	return &c
+}
+
+func (m *AVLMap) GetInorder() []Entry {
+	var res []Entry
+	for it := m.Seek(""); it.Next(); {
+		res = append(res, Entry{Key: it.Key(), Value: it.Value()})
+	}
+	return res
+}
+
+func height(n *avlNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func newNode(key, value string, left, right *avlNode) *avlNode {
+	return &avlNode{key: key, value: value, left: left, right: right, height: 1 + max(height(left), height(right))}
+}
+
+// balance(key, value, left, right) builds a node over left & right, rotating
+// when their heights differ by 2
+func balance(key, value string, left, right *avlNode) *avlNode {
+	hl, hr := height(left), height(right)
+	if hl > hr+1 {
+		if height(left.left) >= height(left.right) {
+			return newNode(left.key, left.value, left.left, newNode(key, value, left.right, right))
+		}
+		lr := left.right
+		return newNode(lr.key, lr.value,
+			newNode(left.key, left.value, left.left, lr.left),
+			newNode(key, value, lr.right, right))
+	}
+	if hr > hl+1 {
+		if height(right.right) >= height(right.left) {
+			return newNode(right.key, right.value, newNode(key, value, left, right.left), right.right)
+		}
+		rl := right.left
+		return newNode(rl.key, rl.value,
+			newNode(key, value, left, rl.left),
+			newNode(right.key, right.value, rl.right, right.right))
+	}
+	return newNode(key, value, left, right)
+}
+
+// insertNode(n, key, value) returns the new subtree and the node key replaced, if any
+func insertNode(n *avlNode, key, value string) (*avlNode, *avlNode) {
+	if n == nil {
+		return newNode(key, value, nil, nil), nil
+	}
+	switch {
+	case key < n.key:
+		left, old := insertNode(n.left, key, value)
+		return balance(n.key, n.value, left, n.right), old
+	case key > n.key:
+		right, old := insertNode(n.right, key, value)
+		return balance(n.key, n.value, n.left, right), old
+	default:
+		return newNode(key, value, n.left, n.right), n
+	}
+}
+
+// deleteNode(n, key) returns the new subtree and the node removed, if any
+func deleteNode(n *avlNode, key string) (*avlNode, *avlNode) {
+	if n == nil {
+		return nil, nil
+	}
+	switch {
+	case key < n.key:
+		left, old := deleteNode(n.left, key)
+		if old == nil {
+			return n, nil
+		}
+		return balance(n.key, n.value, left, n.right), old
+	case key > n.key:
+		right, old := deleteNode(n.right, key)
+		if old == nil {
+			return n, nil
+		}
+		return balance(n.key, n.value, n.left, right), old
+	}
+
+	if n.left == nil {
+		return n.right, n
+	}
+	if n.right == nil {
+		return n.left, n
+	}
+	// the smallest key on the right takes n's place
+	successor := n.right
+	for successor.left != nil {
+		successor = successor.left
+	}
+	right, _ := deleteNode(n.right, successor.key)
+	return balance(successor.key, successor.value, n.left, right), n
+}
+
+// AVLIterator walks the keys of the map it was created from, as they were then, in order
+type AVLIterator struct {
+	// stack holds the nodes still to visit whose left side is done
+	stack []*avlNode
+	cur   *avlNode
+}
+
+// Seek(key) returns an iterator starting at the first key >= key, it keeps walking
+// the map as it was then
+func (m *AVLMap) Seek(key string) MapIterator {
+	it := &AVLIterator{}
+	for n := m.root; n != nil; {
+		if n.key >= key {
+			it.stack = append(it.stack, n)
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return it
+}
+
+// Next() moves onto the next key, returning false once there are none left
+func (it *AVLIterator) Next() bool {
+	if len(it.stack) == 0 {
+		it.cur = nil
+		return false
+	}
+	it.cur = it.stack[len(it.stack)-1]
+	it.stack = it.stack[:len(it.stack)-1]
+	for n := it.cur.right; n != nil; n = n.left {
+		it.stack = append(it.stack, n)
+	}
+	return true
+}
+
+func (it *AVLIterator) Key() string {
+	return it.cur.key
+}
+
+func (it *AVLIterator) Value() string {
+	return it.cur.value
+}
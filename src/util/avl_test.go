@@ -0,0 +1,124 @@
+package util
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// checkBalanced(t, n) returns the height of n, failing if any subtree is out of balance
+func checkBalanced(t *testing.T, n *avlNode) int {
+	if n == nil {
+		return 0
+	}
+	hl, hr := checkBalanced(t, n.left), checkBalanced(t, n.right)
+	if hl-hr > 1 || hr-hl > 1 {
+		t.Fatalf("node %v unbalanced: %v vs %v", n.key, hl, hr)
+	}
+	if n.height != 1+max(hl, hr) {
+		t.Fatalf("node %v height %v want %v", n.key, n.height, 1+max(hl, hr))
+	}
+	return n.height
+}
+
+func TestAVLMapMatchesMap(t *testing.T) {
+	m := NewAVLMap()
+	want := map[string]string{}
+	r := rand.New(rand.NewSource(3))
+	for i := range 5000 {
+		key := fmt.Sprintf("key%04d", r.Intn(1000))
+		if r.Intn(4) == 0 {
+			_, had := want[key]
+			if m.Delete(key) != had {
+				t.Fatalf("delete %v reported %v", key, !had)
+			}
+			delete(want, key)
+			continue
+		}
+		val := fmt.Sprintf("v%v", i)
+		m.Insert(key, val)
+		want[key] = val
+	}
+	checkBalanced(t, m.root)
+
+	wantSize := 0
+	for k, v := range want {
+		wantSize += AVL_NODE_SIZE + len(k) + len(v)
+		if got, ok := m.Get(k); !ok || got != v {
+			t.Fatalf("key %v got %v %v want %v", k, got, ok, v)
+		}
+	}
+	if m.GetSize() != wantSize || m.Len() != len(want) {
+		t.Fatalf("size %v len %v want %v %v", m.GetSize(), m.Len(), wantSize, len(want))
+	}
+
+	got := map[string]string{}
+	var keys []string
+	for _, e := range m.GetInorder() {
+		got[e.Key] = e.Value
+		keys = append(keys, e.Key)
+	}
+	if !maps.Equal(got, want) || !slices.IsSorted(keys) {
+		t.Fatal("inorder walk doesn't match")
+	}
+}
+
+func TestAVLMapSequentialKeysStayShallow(t *testing.T) {
+	m := NewAVLMap()
+	n := 100000
+	for i := range n {
+		m.Insert(fmt.Sprintf("id%08d", i), "")
+	}
+	// an AVL tree is at most ~1.44 log2(n) high
+	if h, limit := checkBalanced(t, m.root), 1.45*math.Log2(float64(n)); float64(h) > limit {
+		t.Fatalf("height %v over %v", h, limit)
+	}
+}
+
+func TestAVLMapSeek(t *testing.T) {
+	m := NewAVLMap()
+	for _, k := range []string{"b", "d", "f", "h"} {
+		m.Insert(k, k)
+	}
+	for start, want := range map[string][]string{
+		"":  {"b", "d", "f", "h"},
+		"d": {"d", "f", "h"},
+		"e": {"f", "h"},
+		"i": nil,
+	} {
+		var got []string
+		for it := m.Seek(start); it.Next(); {
+			got = append(got, it.Key())
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("seek %q got %v want %v", start, got, want)
+		}
+	}
+}
+
+func TestAVLMapSnapshotIsUnchangedByWrites(t *testing.T) {
+	m := NewAVLMap()
+	for i := range 100 {
+		m.Insert(fmt.Sprintf("key%03d", i), "old")
+	}
+	snap := m.Snapshot()
+	it := snap.Seek("")
+	for i := range 100 {
+		m.Insert(fmt.Sprintf("key%03d", i), "new")
+		m.Delete(fmt.Sprintf("key%03d", i+50))
+	}
+
+	n := 0
+	for it.Next() {
+		if it.Value() != "old" {
+			t.Fatalf("snapshot saw %v=%v", it.Key(), it.Value())
+		}
+		n++
+	}
+	if n != 100 || snap.Len() != 100 {
+		t.Fatalf("snapshot has %v keys, len %v", n, snap.Len())
+	}
+}
@@ -0,0 +1,75 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+// BloomFilter answers "definitely not present" or "maybe present" for a set of keys
+type BloomFilter struct {
+	bits []byte
+	k    uint32
+}
+
+// NewBloomFilter(hashes, fpRate) builds a filter over keys already hashed with BloomHash,
+// sized for a false positive rate of fpRate
+func NewBloomFilter(hashes []uint64, fpRate float64) *BloomFilter {
+	n := max(len(hashes), 1)
+	m := int(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = max(m, 64)
+	k := uint32(max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+
+	bf := &BloomFilter{bits: make([]byte, (m+7)/8), k: k}
+	for _, h := range hashes {
+		bf.add(h)
+	}
+	return bf
+}
+
+// BloomHash(key) hashes key for NewBloomFilter
+func BloomHash(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// probes derive k bit positions from one hash (Kirsch-Mitzenmacher double hashing)
+func (bf *BloomFilter) add(h uint64) {
+	m := uint64(len(bf.bits) * 8)
+	h1, h2 := h, (h>>33)|(h<<31)
+	for i := uint64(0); i < uint64(bf.k); i++ {
+		bit := (h1 + i*h2) % m
+		bf.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// MayContain(key) returns false only if key was never added
+func (bf *BloomFilter) MayContain(key string) bool {
+	h := BloomHash(key)
+	m := uint64(len(bf.bits) * 8)
+	h1, h2 := h, (h>>33)|(h<<31)
+	for i := uint64(0); i < uint64(bf.k); i++ {
+		bit := (h1 + i*h2) % m
+		if bf.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalBinary() encodes the filter as | k (4) | bits |
+func (bf *BloomFilter) MarshalBinary() ([]byte, error) {
+	res := binary.LittleEndian.AppendUint32(nil, bf.k)
+	return append(res, bf.bits...), nil
+}
+
+func (bf *BloomFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < 5 {
+		return errors.New("bloom filter too short")
+	}
+	bf.k = binary.LittleEndian.Uint32(data[:4])
+	bf.bits = append([]byte{}, data[4:]...)
+	return nil
+}
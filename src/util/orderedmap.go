@@ -0,0 +1,25 @@
+package util
+
+// OrderedMap is a string map iterated in key order, the memtable of a Nob.
+// TreeMap, AVLMap & SkipList implement it.
+type OrderedMap interface {
+	// Insert(key, value) adds key or overwrites its value
+	Insert(key, value string)
+	Get(key string) (string, bool)
+	// Seek(key) returns an iterator starting at the first key >= key
+	Seek(key string) MapIterator
+	GetInorder() []Entry
+	// GetSize() returns the bytes held by keys, values & the nodes holding them
+	GetSize() int
+	// Len() returns the number of keys
+	Len() int
+	// Concurrent() reports whether Insert may run alongside other inserts & reads without a lock
+	Concurrent() bool
+}
+
+// MapIterator walks an OrderedMap in key order, Next() moves onto the first key
+type MapIterator interface {
+	Next() bool
+	Key() string
+	Value() string
+}
@@ -0,0 +1,178 @@
+package util
+
+import (
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// orderedMaps are every OrderedMap, for tests & benchmarks run against each
+var orderedMaps = map[string]func() OrderedMap{
+	"TreeMap":  func() OrderedMap { return NewTreeMap() },
+	"AVLMap":   func() OrderedMap { return NewAVLMap() },
+	"SkipList": func() OrderedMap { return NewSkipList() },
+}
+
+func TestOrderedMapsMatchMap(t *testing.T) {
+	for name, newMap := range orderedMaps {
+		t.Run(name, func(t *testing.T) {
+			m := newMap()
+			want := map[string]string{}
+			r := rand.New(rand.NewSource(5))
+			for i := range 3000 {
+				key := fmt.Sprintf("key%04d", r.Intn(1000))
+				val := fmt.Sprintf("v%v", i)
+				m.Insert(key, val)
+				want[key] = val
+			}
+
+			got := map[string]string{}
+			var keys []string
+			for it := m.Seek(""); it.Next(); {
+				got[it.Key()] = it.Value()
+				keys = append(keys, it.Key())
+			}
+			if !maps.Equal(got, want) || !slices.IsSorted(keys) {
+				t.Fatal("iteration doesn't match")
+			}
+			for k, v := range want {
+				if res, ok := m.Get(k); !ok || res != v {
+					t.Fatalf("key %v got %v %v want %v", k, res, ok, v)
+				}
+			}
+			if _, ok := m.Get("nope"); ok {
+				t.Fatal("found a key never inserted")
+			}
+			var firstFrom500 string
+			if it := m.Seek("key0500"); it.Next() {
+				firstFrom500 = it.Key()
+			}
+			if want := keys[sort500(keys)]; firstFrom500 != want {
+				t.Fatalf("seek got %v want %v", firstFrom500, want)
+			}
+		})
+	}
+}
+
+func TestOrderedMapsOverwriteDoesntGrow(t *testing.T) {
+	for name, newMap := range orderedMaps {
+		t.Run(name, func(t *testing.T) {
+			m := newMap()
+			m.Insert("hot", "value")
+			size := m.GetSize()
+			if size <= len("hot")+len("value") {
+				t.Fatalf("size %v doesn't count the node", size)
+			}
+			for range 100 {
+				m.Insert("hot", "value")
+			}
+			m.Insert("hot", "longer value")
+			if m.GetSize() != size+len(" longer") || m.Len() != 1 {
+				t.Fatalf("size %v len %v, want %v 1", m.GetSize(), m.Len(), size+len(" longer"))
+			}
+		})
+	}
+}
+
+// sort500(keys) is the index of the first sorted key >= key0500
+func sort500(keys []string) int {
+	i, _ := slices.BinarySearch(keys, "key0500")
+	return i
+}
+
+// benchmarks insert benchN keys per op, a TreeMap given sequential keys is quadratic
+const benchN = 2000
+
+func sequentialKeys() []string {
+	keys := make([]string, benchN)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("id%08d", i)
+	}
+	return keys
+}
+
+func randomKeys() []string {
+	keys := sequentialKeys()
+	rand.New(rand.NewSource(1)).Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	return keys
+}
+
+func BenchmarkOrderedMapInsertSequential(b *testing.B) {
+	keys := sequentialKeys()
+	for name, newMap := range orderedMaps {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m := newMap()
+				for _, k := range keys {
+					m.Insert(k, "value")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkOrderedMapInsertRandom(b *testing.B) {
+	keys := randomKeys()
+	for name, newMap := range orderedMaps {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m := newMap()
+				for _, k := range keys {
+					m.Insert(k, "value")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkOrderedMapParallel mixes inserts & gets from many goroutines, the maps that
+// aren't safe for concurrent use behind a mutex, as the engine has to use them
+func BenchmarkOrderedMapParallel(b *testing.B) {
+	keys := randomKeys()
+	for name, newMap := range orderedMaps {
+		b.Run(name, func(b *testing.B) {
+			m := newMap()
+			_, concurrent := m.(*SkipList)
+			var mu sync.Mutex
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Int()
+				for pb.Next() {
+					k := keys[i%len(keys)]
+					i++
+					if !concurrent {
+						mu.Lock()
+					}
+					if i%4 == 0 {
+						m.Insert(k, "value")
+					} else {
+						m.Get(k)
+					}
+					if !concurrent {
+						mu.Unlock()
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkOrderedMapGetSequential(b *testing.B) {
+	keys := sequentialKeys()
+	for name, newMap := range orderedMaps {
+		b.Run(name, func(b *testing.B) {
+			m := newMap()
+			for _, k := range keys {
+				m.Insert(k, "value")
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.Get(keys[i%benchN])
+			}
+		})
+	}
+}
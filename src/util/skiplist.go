@@ -0,0 +1,153 @@
+package util
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+	"unsafe"
+)
+
+// SKIPLIST_MAX_HEIGHT is enough levels for ~4^12 keys before searches slow down
+const SKIPLIST_MAX_HEIGHT = 12
+
+// SkipList is an ordered string map safe for concurrent use without a lock.
+//
+// Keys are never removed, so an insert only has to link a new node in front of its
+// successor at each level, with a compare-and-swap per level retried when another
+// insert got there first. Overwrites swap the value of the existing node.
+// Readers & iterators see every insert completed before they reach its key.
+type SkipList struct {
+	head *skipNode
+	size atomic.Int64
+	len  atomic.Int64
+}
+
+type skipNode struct {
+	key   string
+	value atomic.Pointer[string]
+	next  []atomic.Pointer[skipNode]
+}
+
+// nodeSize(height) is the bytes a node of height takes besides its key & value,
+// the value being boxed so it can be swapped atomically
+func nodeSize(height int) int {
+	return int(unsafe.Sizeof(skipNode{})) + height*int(unsafe.Sizeof(atomic.Pointer[skipNode]{})) + int(unsafe.Sizeof(""))
+}
+
+func NewSkipList() *SkipList {
+	return &SkipList{head: &skipNode{next: make([]atomic.Pointer[skipNode], SKIPLIST_MAX_HEIGHT)}}
+}
+
+// randomHeight() returns 1 + the number of levels a node is raised by, each with 1/4 chance
+func randomHeight() int {
+	h := 1
+	for h < SKIPLIST_MAX_HEIGHT && rand.IntN(4) == 0 {
+		h++
+	}
+	return h
+}
+
+// findSplice(key, level, before) walks right from before at level, returning the
+// last node with a smaller key and the node after it
+func findSplice(key string, level int, before *skipNode) (*skipNode, *skipNode) {
+	for {
+		next := before.next[level].Load()
+		if next == nil || next.key >= key {
+			return before, next
+		}
+		before = next
+	}
+}
+
+func (s *SkipList) Insert(key, value string) {
+	var prev, next [SKIPLIST_MAX_HEIGHT]*skipNode
+	before := s.head
+	for level := SKIPLIST_MAX_HEIGHT - 1; level >= 0; level-- {
+		prev[level], next[level] = findSplice(key, level, before)
+		before = prev[level]
+	}
+
+	n := &skipNode{key: key, next: make([]atomic.Pointer[skipNode], randomHeight())}
+	n.value.Store(&value)
+	// level 0 decides whether key is new, n is linked bottom up so it's invisible until then
+	for level := range n.next {
+		for {
+			if level == 0 && next[0] != nil && next[0].key == key {
+				old := next[0].value.Swap(&value)
+				s.size.Add(int64(len(value) - len(*old)))
+				return
+			}
+			n.next[level].Store(next[level])
+			if prev[level].next[level].CompareAndSwap(next[level], n) {
+				break
+			}
+			// another insert linked a node here first
+			prev[level], next[level] = findSplice(key, level, prev[level])
+		}
+	}
+	s.size.Add(int64(nodeSize(len(n.next)) + len(key) + len(value)))
+	s.len.Add(1)
+}
+
+// seekBefore(key) returns the last node with a key < key, the head if there's none
+func (s *SkipList) seekBefore(key string) *skipNode {
+	before := s.head
+	for level := SKIPLIST_MAX_HEIGHT - 1; level >= 0; level-- {
+		before, _ = findSplice(key, level, before)
+	}
+	return before
+}
+
+func (s *SkipList) Get(key string) (string, bool) {
+	n := s.seekBefore(key).next[0].Load()
+	if n == nil || n.key != key {
+		return "", false
+	}
+	return *n.value.Load(), true
+}
+
+// GetSize() returns the bytes held by every key, value & node
+func (s *SkipList) GetSize() int {
+	return int(s.size.Load())
+}
+
+// Len() returns the number of keys
+func (s *SkipList) Len() int {
+	return int(s.len.Load())
+}
+
+func (s *SkipList) Concurrent() bool {
+	return true
+}
+
+func (s *SkipList) GetInorder() []Entry {
+	var res []Entry
+	for it := s.Seek(""); it.Next(); {
+		res = append(res, Entry{Key: it.Key(), Value: it.Value()})
+	}
+	return res
+}
+
+// skipListIterator walks level 0, so it also sees keys inserted ahead of it while it walks
+type skipListIterator struct {
+	cur *skipNode
+}
+
+func (s *SkipList) Seek(key string) MapIterator {
+	return &skipListIterator{cur: s.seekBefore(key)}
+}
+
+func (it *skipListIterator) Next() bool {
+	if it.cur == nil {
+		return false
+	}
+	it.cur = it.cur.next[0].Load()
+	return it.cur != nil
+}
+
+func (it *skipListIterator) Key() string {
+	return it.cur.key
+}
+
+func (it *skipListIterator) Value() string {
+	return *it.cur.value.Load()
+}
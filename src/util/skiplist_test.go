@@ -0,0 +1,66 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// walkedSize(s) adds up the size of every node of s
+func walkedSize(s *SkipList) int {
+	size := 0
+	for n := s.head.next[0].Load(); n != nil; n = n.next[0].Load() {
+		size += nodeSize(len(n.next)) + len(n.key) + len(*n.value.Load())
+	}
+	return size
+}
+
+func TestSkipListSizeAccounting(t *testing.T) {
+	s := NewSkipList()
+	s.Insert("foo", "bar")
+	s.Insert("foo", "barbaz")
+	s.Insert("x", "")
+	if s.GetSize() != walkedSize(s) || s.Len() != 2 {
+		t.Fatalf("size %v want %v, len %v", s.GetSize(), walkedSize(s), s.Len())
+	}
+}
+
+func TestSkipListConcurrentInserts(t *testing.T) {
+	s := NewSkipList()
+	var wg sync.WaitGroup
+	writers, keys := 8, 500
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range keys {
+				// every writer inserts every key, overwrites race with inserts
+				s.Insert(fmt.Sprintf("key%04d", (i*7+w)%keys), fmt.Sprint(w))
+				s.Get(fmt.Sprintf("key%04d", i))
+			}
+		}()
+	}
+	// a reader walking while the writers insert
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			prev := ""
+			for it := s.Seek(""); it.Next(); {
+				if it.Key() <= prev {
+					t.Errorf("%v after %v", it.Key(), prev)
+					return
+				}
+				prev = it.Key()
+			}
+		}
+	}()
+	wg.Wait()
+
+	if n := len(s.GetInorder()); n != keys || s.Len() != keys {
+		t.Fatalf("got %v keys, len %v, want %v", n, s.Len(), keys)
+	}
+	if want := walkedSize(s); s.GetSize() != want {
+		t.Fatalf("size %v want %v", s.GetSize(), want)
+	}
+}
@@ -1,8 +1,11 @@
 package util
 
+import "unsafe"
+
 type TreeMap struct {
 	root *TreeNode
 	size int
+	len  int
 }
 
 type TreeNode struct {
@@ -17,16 +20,26 @@ type Entry struct {
 	Value string
 }
 
+// TREE_NODE_SIZE is the bytes a TreeNode takes besides its key & value
+const TREE_NODE_SIZE = int(unsafe.Sizeof(TreeNode{}))
+
 func NewTreeMap() *TreeMap {
 	return &TreeMap{root: nil}
 }
 
 func (tm *TreeMap) Insert(key, value string) {
-	tm.root = insert(tm.root, key, value)
-	tm.size += len(key) + len(value)
+	var oldValue *string
+	tm.root = insert(tm.root, key, value, &oldValue)
+	if oldValue != nil {
+		tm.size += len(value) - len(*oldValue)
+		return
+	}
+	tm.size += TREE_NODE_SIZE + len(key) + len(value)
+	tm.len++
 }
 
-func insert(root *TreeNode, key, value string) *TreeNode {
+// insert(root, key, value, oldValue) points oldValue at the value key had, if any
+func insert(root *TreeNode, key, value string, oldValue **string) *TreeNode {
 	if root == nil {
 		return &TreeNode{
 			key:   key,
@@ -35,10 +48,12 @@ func insert(root *TreeNode, key, value string) *TreeNode {
 	}
 
 	if key < root.key {
-		root.left = insert(root.left, key, value)
+		root.left = insert(root.left, key, value, oldValue)
 	} else if key > root.key {
-		root.right = insert(root.right, key, value)
+		root.right = insert(root.right, key, value, oldValue)
 	} else {
+		old := root.value
+		*oldValue = &old
 		root.value = value
 	}
 	return root
@@ -77,6 +92,57 @@ func inorder(root *TreeNode, res *[]Entry) {
 	inorder(root.right, res)
 }
 
+// GetSize() returns the bytes held by every key, value & node
 func (tm *TreeMap) GetSize() int {
 	return tm.size
 }
+
+// Len() returns the number of keys
+func (tm *TreeMap) Len() int {
+	return tm.len
+}
+
+func (tm *TreeMap) Concurrent() bool {
+	return false
+}
+
+// treeIterator walks a TreeMap in place, it must not be used across an Insert
+type treeIterator struct {
+	// stack holds the nodes still to visit whose left side is done
+	stack []*TreeNode
+	cur   *TreeNode
+}
+
+func (tm *TreeMap) Seek(key string) MapIterator {
+	it := &treeIterator{}
+	for n := tm.root; n != nil; {
+		if n.key >= key {
+			it.stack = append(it.stack, n)
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return it
+}
+
+func (it *treeIterator) Next() bool {
+	if len(it.stack) == 0 {
+		it.cur = nil
+		return false
+	}
+	it.cur = it.stack[len(it.stack)-1]
+	it.stack = it.stack[:len(it.stack)-1]
+	for n := it.cur.right; n != nil; n = n.left {
+		it.stack = append(it.stack, n)
+	}
+	return true
+}
+
+func (it *treeIterator) Key() string {
+	return it.cur.key
+}
+
+func (it *treeIterator) Value() string {
+	return it.cur.value
+}